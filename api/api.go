@@ -2,14 +2,23 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/orchardup/go-orchard/constants"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
+// DefaultTimeout bounds each API request made by clients created with
+// NewHTTPClient.
+var DefaultTimeout = 30 * time.Second
+
 type Host struct {
 	ID         string
 	Name       string
@@ -18,11 +27,40 @@ type Host struct {
 	IPAddress  string `json:"ipv4_address"`
 	ClientKey  string `json:"client_key"`
 	ClientCert string `json:"client_cert"`
+	Status     string
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 type HTTPClient struct {
 	BaseURL string
 	Token   string
+
+	// Client is shared by every request. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Retry controls retries of failed idempotent requests. If nil,
+	// requests are never retried.
+	Retry *RetryPolicy
+
+	// Reauthenticate, if set, is called with the rejected token when a
+	// request fails with 401 Unauthorized, such as because the token has
+	// expired or been revoked. If it returns a new token, the client uses
+	// it from then on, and the request is retried once with it.
+	Reauthenticate func(ctx context.Context, rejectedToken string) (string, error)
+
+	// Guards Token, which Reauthenticate can change while other requests
+	// are being made.
+	mu sync.Mutex
+}
+
+func NewHTTPClient(baseURL, token string) *HTTPClient {
+	retry := DefaultRetryPolicy
+	return &HTTPClient{
+		BaseURL: baseURL,
+		Token:   token,
+		Client:  &http.Client{Timeout: DefaultTimeout},
+		Retry:   &retry,
+	}
 }
 
 type AuthResponse struct {
@@ -30,9 +68,19 @@ type AuthResponse struct {
 }
 
 func (client *HTTPClient) GetAuthToken(username string, password string) (string, error) {
-	resp, err := http.PostForm(client.BaseURL+"/signin",
-		url.Values{"username": {username}, "password": {password}})
+	return client.GetAuthTokenContext(context.Background(), username, password)
+}
 
+func (client *HTTPClient) GetAuthTokenContext(ctx context.Context, username string, password string) (string, error) {
+	form := url.Values{"username": {username}, "password": {password}}
+	req, err := http.NewRequest("POST", client.BaseURL+"/signin", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", fmt.Sprintf("orchard/%s", constants.Version))
+
+	resp, err := client.httpClient().Do(req.WithContext(ctx))
 	if err != nil {
 		return "", err
 	}
@@ -46,32 +94,87 @@ func (client *HTTPClient) GetAuthToken(username string, password string) (string
 	return authResponse.Token, nil
 }
 
+// Account is the user an API token belongs to.
+type Account struct {
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+}
+
+func (client *HTTPClient) GetAccount() (*Account, error) {
+	return client.GetAccountContext(context.Background())
+}
+
+func (client *HTTPClient) GetAccountContext(ctx context.Context) (*Account, error) {
+	req, err := http.NewRequest("GET", client.BaseURL+"/account", nil)
+	if err != nil {
+		return nil, err
+	}
+	var account Account
+	if err := client.DoRequestContext(ctx, req, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (client *HTTPClient) RevokeToken() (bool, error) {
+	return client.RevokeTokenContext(context.Background())
+}
+
+// RevokeTokenContext revokes the client's token, so that it can't be used
+// again. It returns false if the API doesn't support revoking tokens.
+func (client *HTTPClient) RevokeTokenContext(ctx context.Context) (bool, error) {
+	req, err := http.NewRequest("POST", client.BaseURL+"/signout", nil)
+	if err != nil {
+		return false, err
+	}
+	err = client.DoRequestContext(ctx, req, nil)
+	if apiErr, ok := err.(*Error); ok && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusMethodNotAllowed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (client *HTTPClient) GetHosts() ([]*Host, error) {
+	return client.GetHostsContext(context.Background())
+}
+
+func (client *HTTPClient) GetHostsContext(ctx context.Context) ([]*Host, error) {
 	req, err := http.NewRequest("GET", client.BaseURL+"/hosts", nil)
 	if err != nil {
 		return nil, err
 	}
 
 	var hosts []*Host
-	if err := client.DoRequest(req, &hosts); err != nil {
+	if err := client.DoRequestContext(ctx, req, &hosts); err != nil {
 		return nil, err
 	}
 	return hosts, nil
 }
 
 func (client *HTTPClient) GetHost(name string) (*Host, error) {
+	return client.GetHostContext(context.Background(), name)
+}
+
+func (client *HTTPClient) GetHostContext(ctx context.Context, name string) (*Host, error) {
 	req, err := http.NewRequest("GET", client.BaseURL+"/hosts/"+name, nil)
 	if err != nil {
 		return nil, err
 	}
 	var host Host
-	if err := client.DoRequest(req, &host); err != nil {
+	if err := client.DoRequestContext(ctx, req, &host); err != nil {
 		return nil, err
 	}
 	return &host, nil
 }
 
 func (client *HTTPClient) CreateHost(name string, ramInMB int) (*Host, error) {
+	return client.CreateHostContext(context.Background(), name, ramInMB)
+}
+
+func (client *HTTPClient) CreateHostContext(ctx context.Context, name string, ramInMB int) (*Host, error) {
 	v := make(map[string]interface{})
 	v["name"] = name
 	v["size"] = ramInMB
@@ -85,19 +188,30 @@ func (client *HTTPClient) CreateHost(name string, ramInMB int) (*Host, error) {
 		return nil, err
 	}
 
+	// Lets the request be retried without risk of creating the host twice.
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Idempotency-Key", key)
+
 	var host Host
-	if err := client.DoRequest(req, &host); err != nil {
+	if err := client.DoRequestContext(ctx, req, &host); err != nil {
 		return nil, err
 	}
 	return &host, nil
 }
 
 func (client *HTTPClient) DeleteHost(name string) error {
+	return client.DeleteHostContext(context.Background(), name)
+}
+
+func (client *HTTPClient) DeleteHostContext(ctx context.Context, name string) error {
 	req, err := http.NewRequest("DELETE", client.BaseURL+"/hosts/"+name, nil)
 	if err != nil {
 		return err
 	}
-	if err := client.DoRequest(req, nil); err != nil {
+	if err := client.DoRequestContext(ctx, req, nil); err != nil {
 		return err
 	}
 
@@ -105,20 +219,70 @@ func (client *HTTPClient) DeleteHost(name string) error {
 }
 
 func (client *HTTPClient) DoRequest(req *http.Request, v interface{}) error {
-	cl := &http.Client{}
-	req.Header.Set("Authorization", "Token "+client.Token)
+	return client.DoRequestContext(req.Context(), req, v)
+}
+
+func (client *HTTPClient) DoRequestContext(ctx context.Context, req *http.Request, v interface{}) error {
+	token := client.token()
+	req.Header.Set("Authorization", "Token "+token)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", fmt.Sprintf("orchard/%s", constants.Version))
-	resp, err := cl.Do(req)
+	resp, err := client.do(ctx, req)
 	if err != nil {
 		return err
 	}
+
+	// A request with a body that can't be sent again gets the 401.
+	canResend := req.Body == nil || req.GetBody != nil
+	if resp.StatusCode == http.StatusUnauthorized && client.Reauthenticate != nil && canResend {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		newToken, err := client.Reauthenticate(ctx, token)
+		if err != nil {
+			return err
+		}
+		client.setToken(newToken)
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			req.Body = body
+		}
+		req.Header.Set("Authorization", "Token "+newToken)
+		resp, err = client.do(ctx, req)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
 	if err := DecodeResponse(resp, v); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (client *HTTPClient) token() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.Token
+}
+
+func (client *HTTPClient) setToken(token string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.Token = token
+}
+
+func (client *HTTPClient) httpClient() *http.Client {
+	if client.Client != nil {
+		return client.Client
+	}
+	return http.DefaultClient
+}
+
 func DecodeResponse(resp *http.Response, v interface{}) error {
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -126,16 +290,7 @@ func DecodeResponse(resp *http.Response, v interface{}) error {
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		explanation := string(body)
-		var jsonError map[string]interface{}
-
-		if err := json.Unmarshal(body, &jsonError); err == nil {
-			if jsonError["detail"] != nil {
-				explanation = jsonError["detail"].(string)
-			}
-		}
-
-		return fmt.Errorf("The Orchard API returned an error: %s", explanation)
+		return NewError(resp.StatusCode, body)
 	}
 
 	if v != nil {
@@ -1,12 +1,21 @@
 package api
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestGetHosts(t *testing.T) {
@@ -25,7 +34,7 @@ func TestGetHosts(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	client := HTTPClient{ts.URL, "dummy_token"}
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
 
 	hosts, err := client.GetHosts()
 	if err != nil {
@@ -69,7 +78,7 @@ func TestCreateHost(t *testing.T) {
     }`)
 	}))
 
-	client := HTTPClient{ts.URL, "dummy_token"}
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
 
 	host, err := client.CreateHost("newhost", 512)
 	if err != nil {
@@ -89,7 +98,7 @@ func TestDeleteHost(t *testing.T) {
 		fmt.Fprintln(w, "")
 	}))
 
-	client := HTTPClient{ts.URL, "dummy_token"}
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
 
 	err := client.DeleteHost("myhost")
 	if err != nil {
@@ -103,10 +112,510 @@ func TestDeleteHostError(t *testing.T) {
 		fmt.Fprintln(w, "I broke :(")
 	}))
 
-	client := HTTPClient{ts.URL, "dummy_token"}
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
 
 	err := client.DeleteHost("myhost")
 	if err == nil {
 		t.Error("expected DeleteHost() to return an error")
 	}
 }
+
+func TestGetHostNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, `{"detail": "Not found"}`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	_, err := client.GetHost("myhost")
+	if !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %#v", err)
+	}
+	if err.Error() != "The Orchard API returned an error: Not found" {
+		t.Errorf("unexpected error message: %s", err)
+	}
+}
+
+func TestCreateHostConflict(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(409)
+		fmt.Fprintln(w, `{"detail": "A host with that name is already running."}`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	_, err := client.CreateHost("newhost", 512)
+	if !IsConflict(err) {
+		t.Errorf("expected a conflict error, got %#v", err)
+	}
+	if IsNotFound(err) {
+		t.Errorf("didn't expect a not found error, got %#v", err)
+	}
+}
+
+func TestCreateHostDuplicateName(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"name": ["Host with this Name already exists."]}`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	_, err := client.CreateHost("newhost", 512)
+	if !IsConflict(err) {
+		t.Errorf("expected a conflict error, got %#v", err)
+	}
+	if !IsInvalidField(err, "name") {
+		t.Errorf("expected a validation error for 'name', got %#v", err)
+	}
+}
+
+func TestCreateHostValidationError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, `{"size": ["Unsupported size: 3"], "code": "invalid_size"}`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	_, err := client.CreateHost("newhost", 3)
+	if !IsInvalidField(err, "size") {
+		t.Errorf("expected a validation error for 'size', got %#v", err)
+	}
+	if IsInvalidField(err, "name") {
+		t.Errorf("didn't expect a validation error for 'name', got %#v", err)
+	}
+	if IsConflict(err) {
+		t.Errorf("didn't expect a conflict error, got %#v", err)
+	}
+
+	apiErr := err.(*Error)
+	if apiErr.StatusCode != 400 {
+		t.Errorf("expected status 400, got %d", apiErr.StatusCode)
+	}
+	if apiErr.Code != "invalid_size" {
+		t.Errorf("expected code 'invalid_size', got '%s'", apiErr.Code)
+	}
+	if err.Error() != "The Orchard API returned an error: size: Unsupported size: 3" {
+		t.Errorf("unexpected error message: %s", err)
+	}
+}
+
+func TestGetHostsTimeout(t *testing.T) {
+	done := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	client := NewHTTPClient(ts.URL, "dummy_token")
+	client.Client.Timeout = 50 * time.Millisecond
+
+	_, err := client.GetHosts()
+	if err == nil {
+		t.Error("expected GetHosts() to time out")
+	}
+}
+
+func TestGetHostsContextCanceled(t *testing.T) {
+	done := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := client.GetHostsContext(ctx)
+	if err == nil {
+		t.Error("expected GetHostsContext() to return an error once canceled")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("expected context to be canceled, got %v", ctx.Err())
+	}
+}
+
+var testRetryPolicy = RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func TestGetHostsRetriesUnavailable(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprintln(w, `[{"name": "default_bfirsh"}]`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token", Retry: &testRetryPolicy}
+
+	hosts, err := client.GetHosts()
+	if err != nil {
+		t.Error(err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+	if len(hosts) != 1 {
+		t.Errorf("expected 1 element, got %d (hosts: %v)", len(hosts), hosts)
+	}
+}
+
+func TestGetHostsGivesUpAfterMaxRetries(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(502)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token", Retry: &testRetryPolicy}
+
+	_, err := client.GetHosts()
+	if err == nil {
+		t.Error("expected GetHosts() to return an error")
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestDeleteHostDoesNotRetryServerError(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token", Retry: &testRetryPolicy}
+
+	client.DeleteHost("myhost")
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestCreateHostRetriesWithIdempotencyKey(t *testing.T) {
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var data map[string]interface{}
+		json.Unmarshal(body, &data)
+		if data["name"] != "newhost" {
+			t.Errorf("expected 'newhost', got '%s'", data["name"])
+		}
+
+		if len(keys) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(201)
+		fmt.Fprintln(w, `{"name": "newhost"}`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token", Retry: &testRetryPolicy}
+
+	_, err := client.CreateHost("newhost", 512)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(keys))
+	}
+	if keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("expected the same Idempotency-Key on both requests, got %q and %q", keys[0], keys[1])
+	}
+}
+
+func TestGetAuthTokenDoesNotRetry(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Retry: &testRetryPolicy}
+
+	client.GetAuthToken("user", "pass")
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestGetHostsRetriesConnectionReset(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 2 {
+			// Closing with no linger time resets the connection.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		}
+		fmt.Fprintln(w, `[{"name": "default_bfirsh"}]`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token", Retry: &testRetryPolicy}
+
+	hosts, err := client.GetHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || len(hosts) != 1 {
+		t.Errorf("expected 2 requests and 1 host, got %d and %v", requests, hosts)
+	}
+}
+
+func TestGetHostsCapsRetryAfter(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token", Retry: &testRetryPolicy}
+
+	start := time.Now()
+	if _, err := client.GetHosts(); err == nil {
+		t.Error("expected GetHosts() to return an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected Retry-After to be capped, waited %s", elapsed)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&url.Error{Op: "Get", URL: "https://api", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, true},
+		{&url.Error{Op: "Get", URL: "https://api", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, true},
+		{&url.Error{Op: "Get", URL: "https://api", Err: &net.DNSError{Err: "no such host", Name: "api", IsNotFound: true}}, false},
+		{&url.Error{Op: "Get", URL: "https://api", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Get", URL: "https://api", Err: &net.DNSError{Err: "timeout", Name: "api", IsTimeout: true}}, false},
+		{&net.DNSError{Err: "server misbehaving", Name: "api", IsTemporary: true}, true},
+		{errors.New("unexpected"), false},
+	}
+	for _, test := range tests {
+		if retryable := isRetryableError(context.Background(), test.err); retryable != test.retryable {
+			t.Errorf("%v: expected retryable to be %v", test.err, test.retryable)
+		}
+	}
+}
+
+func TestGetAccount(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/account" {
+			t.Errorf("expected HTTP request to /account, got %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Token dummy_token" {
+			t.Errorf("expected token in Authorization header, got %q", auth)
+		}
+		fmt.Fprintln(w, `{"username": "bfirsh", "email": "ben@example.com"}`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	account, err := client.GetAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Username != "bfirsh" {
+		t.Errorf("expected bfirsh, got %s", account.Username)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	supported := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/signout" {
+			t.Errorf("expected POST to /signout, got %s %s", r.Method, r.URL.Path)
+		}
+		if !supported {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	revoked, err := client.RevokeToken()
+	if err != nil || !revoked {
+		t.Errorf("expected token to be revoked, got %v, %v", revoked, err)
+	}
+
+	supported = false
+	revoked, err = client.RevokeToken()
+	if err != nil || revoked {
+		t.Errorf("expected revoking to be unsupported, got %v, %v", revoked, err)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token new_token" {
+			w.WriteHeader(401)
+			fmt.Fprintln(w, `{"detail": "Invalid token."}`)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == "POST" && !strings.Contains(string(body), "web") {
+			t.Errorf("expected the request body to be sent again, got %q", body)
+		}
+		fmt.Fprintln(w, `{"name": "web"}`)
+	}))
+	defer ts.Close()
+
+	calls := 0
+	client := HTTPClient{BaseURL: ts.URL, Token: "old_token"}
+	client.Reauthenticate = func(ctx context.Context, rejectedToken string) (string, error) {
+		calls++
+		if rejectedToken != "old_token" {
+			t.Errorf("expected the rejected token, got %q", rejectedToken)
+		}
+		return "new_token", nil
+	}
+
+	if _, err := client.CreateHost("web", 512); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || client.Token != "new_token" {
+		t.Errorf("expected 1 call and the new token, got %d and %q", calls, client.Token)
+	}
+	if _, err := client.GetHost("web"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the new token to be kept, got %d calls", calls)
+	}
+
+	client.Token = "old_token"
+	client.Reauthenticate = func(ctx context.Context, rejectedToken string) (string, error) {
+		return "", errors.New("not logged in")
+	}
+	if _, err := client.GetHosts(); err == nil || err.Error() != "not logged in" {
+		t.Errorf("expected Reauthenticate's error, got %v", err)
+	}
+
+	client.Reauthenticate = func(ctx context.Context, rejectedToken string) (string, error) {
+		return "another_token", nil
+	}
+	if _, err := client.GetHosts(); !IsUnauthorized(err) {
+		t.Errorf("expected the retried request's 401 to be returned, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", "2")
+	if wait := retryAfter(resp); wait != 2*time.Second {
+		t.Errorf("expected 2s, got %s", wait)
+	}
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if wait := retryAfter(resp); wait <= 0 || wait > time.Minute {
+		t.Errorf("expected up to 1m, got %s", wait)
+	}
+
+	resp.Header.Set("Retry-After", "soon")
+	if wait := retryAfter(resp); wait != 0 {
+		t.Errorf("expected 0, got %s", wait)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 5, MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		backoff := policy.Backoff(retry)
+		if backoff < max/2 || backoff > max {
+			t.Errorf("retry %d: expected backoff between %s and %s, got %s", retry, max/2, max, backoff)
+		}
+	}
+}
+
+func TestWaitForHost(t *testing.T) {
+	HostPollInterval = time.Millisecond
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosts/newhost" {
+			t.Errorf("expected HTTP request to /hosts/newhost, got %s", r.URL.Path)
+		}
+
+		requests++
+		status := "creating"
+		if requests == 3 {
+			status = "running"
+		}
+		fmt.Fprintf(w, `{"name": "newhost", "status": %q, "created_at": "2014-07-14T12:00:00Z"}`, status)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	host, err := client.WaitForHost(context.Background(), "newhost", HostRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+	if host.Status != HostRunning {
+		t.Errorf("expected status 'running', got '%s'", host.Status)
+	}
+	if host.CreatedAt.Year() != 2014 {
+		t.Errorf("expected host to be created in 2014, got %s", host.CreatedAt)
+	}
+}
+
+func TestWaitForHostError(t *testing.T) {
+	HostPollInterval = time.Millisecond
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"name": "newhost", "status": "error"}`)
+	}))
+	defer ts.Close()
+
+	client := HTTPClient{BaseURL: ts.URL, Token: "dummy_token"}
+
+	_, err := client.WaitForHost(context.Background(), "newhost", HostRunning)
+	if err == nil {
+		t.Error("expected WaitForHost() to return an error")
+	}
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Machine-readable error codes. The API may send its own "code" in the
+// response body; if it doesn't, one is derived from the HTTP status.
+const (
+	CodeInvalid      = "invalid"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeThrottled    = "throttled"
+	CodeServerError  = "server_error"
+	CodeUnknown      = "unknown"
+)
+
+// Error is returned for any non-2xx response from the Orchard API.
+type Error struct {
+	StatusCode int
+	Code       string
+	Detail     string
+	Fields     map[string][]string
+	Body       string
+}
+
+func (e *Error) Error() string {
+	explanation := e.Detail
+
+	if explanation == "" && len(e.Fields) > 0 {
+		var names []string
+		for name := range e.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var parts []string
+		for _, name := range names {
+			parts = append(parts, fmt.Sprintf("%s: %s", name, strings.Join(e.Fields[name], " ")))
+		}
+		explanation = strings.Join(parts, "; ")
+	}
+
+	if explanation == "" {
+		explanation = e.Body
+	}
+
+	if explanation == "" {
+		explanation = http.StatusText(e.StatusCode)
+	}
+
+	return fmt.Sprintf("The Orchard API returned an error: %s", explanation)
+}
+
+// FieldErrors returns the validation messages for the given field, if any.
+func (e *Error) FieldErrors(field string) []string {
+	return e.Fields[field]
+}
+
+func NewError(statusCode int, body []byte) *Error {
+	apiErr := &Error{
+		StatusCode: statusCode,
+		Body:       strings.TrimSpace(string(body)),
+	}
+
+	var jsonError map[string]interface{}
+	if err := json.Unmarshal(body, &jsonError); err == nil {
+		for key, value := range jsonError {
+			switch key {
+			case "detail":
+				if detail, ok := value.(string); ok {
+					apiErr.Detail = detail
+				}
+			case "code":
+				if code, ok := value.(string); ok {
+					apiErr.Code = code
+				}
+			default:
+				if messages := fieldMessages(value); len(messages) > 0 {
+					if apiErr.Fields == nil {
+						apiErr.Fields = make(map[string][]string)
+					}
+					apiErr.Fields[key] = messages
+				}
+			}
+		}
+	}
+
+	if apiErr.Code == "" {
+		apiErr.Code = codeForStatus(statusCode)
+	}
+
+	return apiErr
+}
+
+func fieldMessages(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var messages []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				messages = append(messages, s)
+			}
+		}
+		return messages
+	}
+	return nil
+}
+
+func codeForStatus(statusCode int) string {
+	switch {
+	case statusCode == http.StatusBadRequest:
+		return CodeInvalid
+	case statusCode == http.StatusUnauthorized:
+		return CodeUnauthorized
+	case statusCode == http.StatusForbidden:
+		return CodeForbidden
+	case statusCode == http.StatusNotFound:
+		return CodeNotFound
+	case statusCode == http.StatusConflict:
+		return CodeConflict
+	case statusCode == 429:
+		return CodeThrottled
+	case statusCode >= 500:
+		return CodeServerError
+	}
+	return CodeUnknown
+}
+
+func hasCode(err error, code string) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.Code == code
+}
+
+// IsNotFound reports whether err is an API error for a missing resource.
+func IsNotFound(err error) bool {
+	return hasCode(err, CodeNotFound)
+}
+
+// IsConflict reports whether err is an API error for a resource that
+// already exists. As well as a 409, that's a validation error with a
+// field message saying so, which is how the API reports a duplicate host
+// name.
+func IsConflict(err error) bool {
+	if hasCode(err, CodeConflict) {
+		return true
+	}
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, messages := range apiErr.Fields {
+		for _, message := range messages {
+			if strings.Contains(strings.ToLower(message), "already exists") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUnauthorized reports whether err is an API error for a missing,
+// expired or revoked token.
+func IsUnauthorized(err error) bool {
+	return hasCode(err, CodeUnauthorized)
+}
+
+// IsInvalid reports whether err is an API validation error.
+func IsInvalid(err error) bool {
+	return hasCode(err, CodeInvalid)
+}
+
+// IsInvalidField reports whether err is an API validation error that
+// concerns the given field.
+func IsInvalidField(err error, field string) bool {
+	apiErr, ok := err.(*Error)
+	return ok && len(apiErr.FieldErrors(field)) > 0
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decides how often and how long to wait before a failed
+// API request is tried again. Only idempotent requests are retried:
+// GETs, HEADs, DELETEs, and anything carrying an Idempotency-Key header.
+// A server's Retry-After is honoured, up to MaxBackoff.
+type RetryPolicy struct {
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used by clients created with NewHTTPClient.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	MinBackoff: 500 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+}
+
+// Backoff returns how long to wait before the given retry (counting
+// from 0), using exponential backoff with jitter.
+func (policy *RetryPolicy) Backoff(retry int) time.Duration {
+	backoff := policy.MinBackoff
+	for i := 0; i < retry && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	// Wait somewhere between half and all of the backoff, so that
+	// clients that failed together don't all retry together.
+	half := int64(backoff / 2)
+	return time.Duration(half + mathrand.Int63n(half+1))
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case 429, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Only errors that another attempt might not hit are retried: the
+// connection being refused or reset, or errors the net package reports
+// as temporary. Certificate errors, unknown hosts and the like will
+// happen again, and timeouts have already used up the time allowed.
+func isRetryableError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return !netErr.Timeout() && netErr.Temporary()
+	}
+	return false
+}
+
+// Parses a Retry-After header, which is either a number of seconds or
+// an HTTP date. Returns 0 if the header is missing or invalid. The caller
+// caps it, so a server can't keep a request waiting indefinitely.
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(time.Now()); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sends the request, retrying according to the client's RetryPolicy.
+func (client *HTTPClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+
+	maxRetries := 0
+	if client.Retry != nil && isIdempotent(req) && (req.Body == nil || req.GetBody != nil) {
+		maxRetries = client.Retry.MaxRetries
+	}
+
+	for retry := 0; ; retry++ {
+		if retry > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := client.httpClient().Do(req)
+		if retry >= maxRetries {
+			return resp, err
+		}
+
+		wait := client.Retry.Backoff(retry)
+		if err != nil {
+			if !isRetryableError(ctx, err) {
+				return nil, err
+			}
+		} else {
+			if !isRetryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			if after := retryAfter(resp); after > 0 {
+				wait = after
+				if wait > client.Retry.MaxBackoff {
+					wait = client.Retry.MaxBackoff
+				}
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Host states reported by the API in Host.Status.
+const (
+	HostCreating = "creating"
+	HostRunning  = "running"
+	HostError    = "error"
+)
+
+// HostPollInterval is how long WaitForHost waits between requests.
+var HostPollInterval = 2 * time.Second
+
+// WaitForHost polls the API until the named host reaches the given state,
+// the host fails, or the context is done. Hosts whose status isn't
+// reported by the API are assumed to be running.
+func (client *HTTPClient) WaitForHost(ctx context.Context, name string, state string) (*Host, error) {
+	for {
+		host, err := client.GetHostContext(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		status := host.Status
+		if status == "" {
+			status = HostRunning
+		}
+
+		if status == state {
+			return host, nil
+		}
+		if status == HostError {
+			return host, fmt.Errorf("Host %q failed to start", name)
+		}
+
+		if err := sleepContext(ctx, HostPollInterval); err != nil {
+			return host, err
+		}
+	}
+}
@@ -1,77 +1,348 @@
 package authenticator
 
 import (
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/utils"
 	"github.com/orchardup/go-orchard/vendor/code.google.com/p/gopass"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync"
 )
 
-func Authenticate() (*api.HTTPClient, error) {
-	httpClient := api.HTTPClient{GetAPIURL(), ""}
-	err := PopulateToken(&httpClient)
+func Authenticate(ctx context.Context) (*api.HTTPClient, error) {
+	httpClient := api.NewHTTPClient(GetAPIURL(), "")
+	err := PopulateToken(ctx, httpClient)
 	if err != nil {
 		return nil, err
 	}
-	return &httpClient, nil
+	return httpClient, nil
 }
 
-func PopulateToken(httpClient *api.HTTPClient) error {
-	envVar := os.Getenv("ORCHARD_API_TOKEN")
-	if envVar != "" {
-		httpClient.Token = envVar
+func PopulateToken(ctx context.Context, httpClient *api.HTTPClient) error {
+	httpClient.Reauthenticate = reauthenticator(httpClient)
+
+	token, err := Token(httpClient.BaseURL)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		httpClient.Token = token
 		return nil
 	}
 
-	tokenFile, err := GetTokenFilePath(httpClient.BaseURL)
+	username, password, err := Credentials(ctx)
+	if err == ErrNoTerminal {
+		return fmt.Errorf("Not logged in at %s, and there's no terminal to ask for your username and password on. Set ORCHARD_API_TOKEN or ORCHARD_API_TOKEN_FILE, or ORCHARD_USERNAME and ORCHARD_PASSWORD_FILE, or run 'orchard login' first.", httpClient.BaseURL)
+	}
+	if err != nil {
+		return err
+	}
+	token, err = logIn(ctx, httpClient, username, password)
 	if err != nil {
 		return err
 	}
+	httpClient.Token = token
+	return nil
+}
+
+// Gets a token for the user and saves it, for commands that log in
+// because they need to rather than because they were asked to.
+func logIn(ctx context.Context, httpClient *api.HTTPClient, username, password string) (string, error) {
+	token, err := httpClient.GetAuthTokenContext(ctx, username, password)
+	if api.IsUnauthorized(err) || api.IsInvalid(err) {
+		if os.Getenv("ORCHARD_PASSWORD_FILE") != "" {
+			return "", errors.New("Login with ORCHARD_USERNAME and ORCHARD_PASSWORD_FILE failed: wrong username or password")
+		}
+		return "", errors.New("Login failed: wrong username or password")
+	}
+	if err != nil {
+		return "", err
+	}
 
-	if _, err := os.Stat(tokenFile); os.IsNotExist(err) {
-		token, err := GetTokenByPromptingUser(*httpClient)
+	// The command can go ahead with the token even if it can't be saved,
+	// such as when there's no terminal to ask for a passphrase on.
+	if err := SaveToken(httpClient.BaseURL, token); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+	}
+	return token, nil
+}
+
+// Returns a function for the client's Reauthenticate. When the API
+// rejects the saved token, it's deleted, and the user is asked to log in
+// again, once. Tokens from the environment are left alone, as the user
+// needs to replace them.
+func reauthenticator(httpClient *api.HTTPClient) func(ctx context.Context, rejectedToken string) (string, error) {
+	var mu sync.Mutex
+	attempted := false
+	newToken := ""
+
+	return func(ctx context.Context, rejectedToken string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Another request has already logged in again.
+		if newToken != "" && newToken != rejectedToken {
+			return newToken, nil
+		}
+		baseURL := httpClient.BaseURL
+		if attempted {
+			return "", fmt.Errorf("The Orchard API at %s still isn't accepting your API token. Run 'orchard login' to log in again.", baseURL)
+		}
+		attempted = true
+
+		_, source, err := environmentToken()
 		if err != nil {
-			return err
+			return "", err
 		}
-		if err := ioutil.WriteFile(tokenFile, []byte(token), 0644); err != nil {
-			return err
+		if source != "" {
+			return "", fmt.Errorf("The API token in %s isn't valid for %s. It may have expired or been revoked.", source, baseURL)
 		}
-		httpClient.Token = token
-	} else {
-		token, err := ioutil.ReadFile(tokenFile)
+
+		if err := DeleteToken(baseURL); err != nil {
+			return "", err
+		}
+		canLogIn := utils.IsTerminal(os.Stdin) || (os.Getenv("ORCHARD_USERNAME") != "" && os.Getenv("ORCHARD_PASSWORD_FILE") != "")
+		if !canLogIn {
+			return "", fmt.Errorf("Your saved API token for %s is no longer valid, so it's been deleted. Run 'orchard login' to log in again.", baseURL)
+		}
+
+		fmt.Fprintf(os.Stderr, "Your saved API token for %s is no longer valid. Log in again to continue.\n", baseURL)
+		username, password, err := Credentials(ctx)
+		if err != nil {
+			return "", err
+		}
+		token, err := logIn(ctx, httpClient, username, password)
 		if err != nil {
-			return err
+			return "", err
 		}
+		newToken = token
+		return token, nil
+	}
+}
+
+// ErrNoTerminal is returned instead of prompting when stdin isn't a
+// terminal, as nobody would be there to answer.
+var ErrNoTerminal = errors.New("Can't prompt for input without a terminal")
+
+// Returns the username and password to log in with: the ones in
+// ORCHARD_USERNAME and the file named by ORCHARD_PASSWORD_FILE, or else
+// prompted for.
+func Credentials(ctx context.Context) (string, string, error) {
+	username := os.Getenv("ORCHARD_USERNAME")
+	if username == "" {
+		var err error
+		username, err = PromptUsername(ctx)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	passwordFile := os.Getenv("ORCHARD_PASSWORD_FILE")
+	if passwordFile != "" {
+		password, err := ReadPasswordFile(passwordFile)
+		if err != nil {
+			return "", "", fmt.Errorf("Error reading ORCHARD_PASSWORD_FILE: %s", err)
+		}
+		return username, password, nil
+	}
+
+	password, err := PromptPassword()
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
+}
 
-		httpClient.Token = string(token)
+// Reads a password or token from a file, such as a mounted secret,
+// without the line ending it may have.
+func ReadPasswordFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("%s is empty", filename)
 	}
+	return password, nil
+}
 
+// Gets a token for the user, and saves it for the client's API.
+func Login(ctx context.Context, httpClient *api.HTTPClient, username, password string) error {
+	// Don't get a token that can't be saved.
+	if _, err := GetTokenStore(); err != nil {
+		return err
+	}
+	token, err := httpClient.GetAuthTokenContext(ctx, username, password)
+	if err != nil {
+		return err
+	}
+	if err := SaveToken(httpClient.BaseURL, token); err != nil {
+		return err
+	}
+	httpClient.Token = token
 	return nil
 }
 
+// Saves the token to use for the API at baseURL in the token store.
+func SaveToken(baseURL, token string) error {
+	store, err := GetTokenStore()
+	if err != nil {
+		return err
+	}
+	key := CurrentTokenKey(baseURL)
+	if err := store.Store(key, token); err != nil {
+		return fmt.Errorf("Error saving API token in %s: %s", store, err)
+	}
+	// Don't leave an older plaintext token lying around.
+	if _, ok := store.(*FileStore); !ok {
+		return (&FileStore{}).Erase(key)
+	}
+	return nil
+}
+
+// Deletes the token saved for the API at baseURL, if there is one.
+func DeleteToken(baseURL string) error {
+	store, err := readTokenStore()
+	if err != nil {
+		return err
+	}
+	key := CurrentTokenKey(baseURL)
+	if err := store.Erase(key); err != nil {
+		return fmt.Errorf("Error deleting API token from %s: %s", store, err)
+	}
+	return (&FileStore{}).Erase(key)
+}
+
+// Returns the token to use for the API at baseURL without prompting: the
+// one in ORCHARD_API_TOKEN or the file named by ORCHARD_API_TOKEN_FILE,
+// or in the variable named by the current profile's token_env, or the
+// saved one. Returns "" if there isn't one.
+func Token(baseURL string) (string, error) {
+	token, _, err := environmentToken()
+	if err != nil || token != "" {
+		return token, err
+	}
+	return SavedToken(baseURL)
+}
+
+// Returns the token set in the environment, and where it came from, or
+// "" if there isn't one.
+func environmentToken() (token string, source string, err error) {
+	if token := os.Getenv("ORCHARD_API_TOKEN"); token != "" {
+		return token, "ORCHARD_API_TOKEN", nil
+	}
+	if tokenFile := os.Getenv("ORCHARD_API_TOKEN_FILE"); tokenFile != "" {
+		token, err := ReadPasswordFile(tokenFile)
+		if err != nil {
+			return "", "", fmt.Errorf("Error reading ORCHARD_API_TOKEN_FILE: %s", err)
+		}
+		return strings.TrimSpace(token), "ORCHARD_API_TOKEN_FILE", nil
+	}
+	if tokenEnv := currentProfileOrEmpty().TokenEnv; tokenEnv != "" {
+		if token := os.Getenv(tokenEnv); token != "" {
+			return token, tokenEnv, nil
+		}
+	}
+	return "", "", nil
+}
+
+// Returns the token saved for the API at baseURL, or "" if the user
+// hasn't logged in to it. Never prompts for credentials, though the
+// encrypted file store may prompt for its passphrase.
+func SavedToken(baseURL string) (string, error) {
+	store, err := readTokenStore()
+	if err != nil {
+		return "", err
+	}
+	notify := func(message string) {
+		fmt.Fprintln(os.Stderr, message)
+	}
+	return savedToken(store, CurrentTokenKey(baseURL), notify)
+}
+
+// NonInteractiveToken is like Token, for library code: it never prompts
+// or writes to the terminal. A token saved in the encrypted file is only
+// read with the passphrase in ORCHARD_TOKEN_PASSPHRASE, and if that isn't
+// set, ErrPassphraseRequired is returned.
+func NonInteractiveToken(baseURL string) (string, error) {
+	token, _, err := environmentToken()
+	if err != nil || token != "" {
+		return token, err
+	}
+
+	store, err := readTokenStore()
+	if err != nil {
+		return "", err
+	}
+	// The shared store may prompt, so a separate one is used.
+	if encrypted, ok := store.(*EncryptedFileStore); ok {
+		store = &EncryptedFileStore{
+			Path:       encrypted.Path,
+			Passphrase: EnvironmentPassphrase,
+			Iterations: encrypted.Iterations,
+		}
+	}
+	return savedToken(store, CurrentTokenKey(baseURL), nil)
+}
+
+// Returns the token saved in store for key, moving one an earlier version
+// saved in a plaintext file into it. Messages about moving it are passed
+// to notify, or dropped if it's nil.
+func savedToken(store TokenStore, key TokenKey, notify func(message string)) (string, error) {
+	token, err := store.Get(key)
+	if err == ErrPassphraseRequired {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error reading API token from %s: %s", store, err)
+	}
+	if token != "" {
+		return token, nil
+	}
+	return migrateToken(store, key, notify)
+}
+
+// Returns the API URL in ORCHARD_API_URL, or the current profile's, or
+// Orchard's own.
 func GetAPIURL() string {
 	apiURL := os.Getenv("ORCHARD_API_URL")
 
 	if apiURL == "" {
-		apiURL = "https://api.orchardup.com/v2"
+		apiURL = currentProfileOrEmpty().APIURL
+	}
+
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
 	}
 
 	return apiURL
 }
 
+// Returns the plaintext file the current profile's token for the API at
+// baseURL is kept in by FileStore.
 func GetTokenFilePath(baseURL string) (string, error) {
+	return getTokenFilePath(CurrentTokenKey(baseURL))
+}
+
+func getTokenFilePath(key TokenKey) (string, error) {
 	tokenDir, err := GetTokenDir()
 	if err != nil {
 		return "", err
 	}
 
+	baseURL := key.APIURL
+
 	// HACK: API URL used to be orchard.com/api, don't invalidate those
 	// tokens
-	if baseURL == "https://api.orchardup.com/v2" {
+	if baseURL == DefaultAPIURL {
 		baseURL = "https://orchardup.com/api/v2"
 	}
 
@@ -79,9 +350,20 @@ func GetTokenFilePath(baseURL string) (string, error) {
 	io.WriteString(h, baseURL)
 	hash := fmt.Sprintf("%x", h.Sum(nil))
 
+	// Each profile has its own tokens, so that profiles can use different
+	// accounts on the same API.
+	if key.Profile != "" {
+		hash = key.Profile + "-" + hash
+	}
+
 	return path.Join(tokenDir, hash), nil
 }
 
+// Returns the file EncryptedFileStore keeps tokens in.
+func GetEncryptedTokenFilePath() string {
+	return path.Join(os.Getenv("HOME"), ".orchard", "api_tokens.enc")
+}
+
 func GetTokenDir() (string, error) {
 	tokenDir := path.Join(os.Getenv("HOME"), ".orchard", "api_tokens")
 	err := os.MkdirAll(tokenDir, 0700)
@@ -91,10 +373,13 @@ func GetTokenDir() (string, error) {
 	return tokenDir, nil
 }
 
-func GetTokenByPromptingUser(httpClient api.HTTPClient) (string, error) {
-	username, password := Prompt()
+func GetTokenByPromptingUser(ctx context.Context, httpClient *api.HTTPClient) (string, error) {
+	username, password, err := Credentials(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	token, err := httpClient.GetAuthToken(username, password)
+	token, err := httpClient.GetAuthTokenContext(ctx, username, password)
 	if err != nil {
 		return "", err
 	}
@@ -102,13 +387,31 @@ func GetTokenByPromptingUser(httpClient api.HTTPClient) (string, error) {
 	return token, nil
 }
 
-func Prompt() (string, string) {
-	var (
-		username string
-		password string
-	)
+func Prompt(ctx context.Context) (string, string, error) {
+	username, err := PromptUsername(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := PromptPassword()
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
+}
+
+// Prompts for a username, or returns ErrNoTerminal.
+func PromptUsername(ctx context.Context) (string, error) {
+	if !utils.IsTerminal(os.Stdin) {
+		return "", ErrNoTerminal
+	}
 	fmt.Print("Orchard username: ")
-	fmt.Scanln(&username)
-	password, _ = gopass.GetPass("Password: ")
-	return username, password
+	return utils.ReadLine(ctx)
+}
+
+// Prompts for a password without echoing it, or returns ErrNoTerminal.
+func PromptPassword() (string, error) {
+	if !utils.IsTerminal(os.Stdin) {
+		return "", ErrNoTerminal
+	}
+	return gopass.GetPass("Password: ")
 }
@@ -0,0 +1,55 @@
+package authenticator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCredentialsFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orchard-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"ORCHARD_API_TOKEN", "ORCHARD_API_TOKEN_FILE", "ORCHARD_USERNAME", "ORCHARD_PASSWORD_FILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+
+	tokenFile := path.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("ORCHARD_API_TOKEN", "")
+	os.Setenv("ORCHARD_API_TOKEN_FILE", tokenFile)
+	if token, err := Token("https://api"); err != nil || token != "secret" {
+		t.Errorf("expected the token from ORCHARD_API_TOKEN_FILE, got %q, %v", token, err)
+	}
+	os.Setenv("ORCHARD_API_TOKEN_FILE", path.Join(dir, "missing"))
+	if _, err := Token("https://api"); err == nil {
+		t.Error("expected an error for a missing ORCHARD_API_TOKEN_FILE")
+	}
+
+	passwordFile := path.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte(" pass word \r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("ORCHARD_USERNAME", "bob")
+	os.Setenv("ORCHARD_PASSWORD_FILE", passwordFile)
+	username, password, err := Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "bob" || password != " pass word " {
+		t.Errorf("expected bob and the password from the file, got %q and %q", username, password)
+	}
+
+	if err := ioutil.WriteFile(passwordFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Credentials(context.Background()); err == nil {
+		t.Error("expected an error for an empty ORCHARD_PASSWORD_FILE")
+	}
+}
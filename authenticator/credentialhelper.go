@@ -0,0 +1,121 @@
+package authenticator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CredentialHelperStore keeps tokens with an external program called
+// orchard-credential-NAME, which speaks the same protocol as Docker's
+// credential helpers, so that those can be reused by linking to them:
+//
+//	get      reads a server URL on stdin, and writes its credentials to
+//	         stdout as JSON, or fails with "credentials not found"
+//	store    reads {"ServerURL", "Username", "Secret"} as JSON on stdin
+//	erase    reads a server URL on stdin
+//	list     writes a JSON object mapping server URLs to usernames
+//
+// Server URLs are TokenKey strings, and tokens are stored as secrets with
+// the username "<token>", as Docker does for identity tokens.
+type CredentialHelperStore struct {
+	Name string
+}
+
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+const helperTokenUsername = "<token>"
+
+// Program returns the name of the helper's executable.
+func (store *CredentialHelperStore) Program() string {
+	return "orchard-credential-" + store.Name
+}
+
+// Reports whether err is a helper saying it has nothing for a server URL.
+func isHelperNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "credentials not found")
+}
+
+func (store *CredentialHelperStore) run(action, input string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(store.Program(), action)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Docker's helpers write their errors to stdout.
+		message := strings.TrimSpace(stdout.String() + "\n" + stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return nil, fmt.Errorf("%s %s: %s", store.Program(), action, message)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (store *CredentialHelperStore) Get(key TokenKey) (string, error) {
+	output, err := store.run("get", key.String())
+	if isHelperNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var credentials helperCredentials
+	if err := json.Unmarshal(output, &credentials); err != nil {
+		return "", fmt.Errorf("%s get: %s", store.Program(), err)
+	}
+	return credentials.Secret, nil
+}
+
+func (store *CredentialHelperStore) Store(key TokenKey, token string) error {
+	input, err := json.Marshal(&helperCredentials{
+		ServerURL: key.String(),
+		Username:  helperTokenUsername,
+		Secret:    token,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = store.run("store", string(input))
+	return err
+}
+
+func (store *CredentialHelperStore) Erase(key TokenKey) error {
+	_, err := store.run("erase", key.String())
+	if isHelperNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (store *CredentialHelperStore) EraseProfile(name string) error {
+	output, err := store.run("list", "")
+	if err != nil {
+		return err
+	}
+	servers := map[string]string{}
+	if err := json.Unmarshal(output, &servers); err != nil {
+		return fmt.Errorf("%s list: %s", store.Program(), err)
+	}
+	for serverURL := range servers {
+		key := parseTokenKey(serverURL)
+		if key.Profile != name {
+			continue
+		}
+		if err := store.Erase(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *CredentialHelperStore) String() string {
+	return store.Program()
+}
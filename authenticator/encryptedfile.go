@@ -0,0 +1,274 @@
+package authenticator
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/orchardup/go-orchard/utils"
+	"github.com/orchardup/go-orchard/vendor/code.google.com/p/go.crypto/pbkdf2"
+	"github.com/orchardup/go-orchard/vendor/code.google.com/p/gopass"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// The number of PBKDF2 iterations used for new files.
+const DefaultPassphraseIterations = 600000
+
+// EncryptedFileStore keeps tokens in a single file, encrypted with
+// AES-256-GCM under a key derived from a passphrase. The passphrase is
+// asked for once per process.
+type EncryptedFileStore struct {
+	Path string
+
+	// Passphrase returns the passphrase, which is a new one if isNew is
+	// set because the file doesn't exist yet.
+	Passphrase func(isNew bool) (string, error)
+
+	// Iterations is the number of PBKDF2 iterations used if the file
+	// doesn't exist yet.
+	Iterations int
+
+	mu     sync.Mutex
+	file   *encryptedTokenFile
+	key    []byte
+	tokens map[string]string
+}
+
+// The file's contents. []byte fields are base64-encoded.
+type encryptedTokenFile struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// NewEncryptedFileStore returns a store for the file at path, taking the
+// passphrase from ORCHARD_TOKEN_PASSPHRASE or prompting for it.
+func NewEncryptedFileStore(path string) *EncryptedFileStore {
+	return &EncryptedFileStore{
+		Path:       path,
+		Passphrase: PromptPassphrase,
+		Iterations: DefaultPassphraseIterations,
+	}
+}
+
+// ErrPassphraseRequired is returned by EnvironmentPassphrase if
+// ORCHARD_TOKEN_PASSPHRASE isn't set.
+var ErrPassphraseRequired = errors.New("orchard: ORCHARD_TOKEN_PASSPHRASE isn't set")
+
+// Returns the passphrase in ORCHARD_TOKEN_PASSPHRASE, for callers that
+// mustn't prompt, or ErrPassphraseRequired.
+func EnvironmentPassphrase(isNew bool) (string, error) {
+	if passphrase := os.Getenv("ORCHARD_TOKEN_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	return "", ErrPassphraseRequired
+}
+
+// Returns the passphrase in ORCHARD_TOKEN_PASSPHRASE, or prompts for it,
+// twice if it's a new one.
+func PromptPassphrase(isNew bool) (string, error) {
+	if passphrase, err := EnvironmentPassphrase(isNew); err == nil {
+		return passphrase, nil
+	}
+	if !utils.IsTerminal(os.Stdin) {
+		return "", errors.New("There's no terminal to ask for the passphrase for saved API tokens on. Set ORCHARD_TOKEN_PASSPHRASE.")
+	}
+	if !isNew {
+		return gopass.GetPass("Passphrase for saved Orchard API tokens: ")
+	}
+
+	passphrase, err := gopass.GetPass("Choose a passphrase to encrypt saved Orchard API tokens with: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("The passphrase can't be empty")
+	}
+	again, err := gopass.GetPass("Passphrase again: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("The passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+func deriveKey(passphrase string, salt []byte, iterations int) ([]byte, error) {
+	if iterations < 1 {
+		return nil, fmt.Errorf("invalid PBKDF2 iteration count %d", iterations)
+	}
+	return pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New), nil
+}
+
+// Reads and decrypts the file the first time it's needed. If it doesn't
+// exist and create isn't set, tokens is left nil without asking for a
+// passphrase.
+func (store *EncryptedFileStore) load(create bool) error {
+	if store.tokens != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(store.Path)
+	if os.IsNotExist(err) {
+		if !create {
+			return nil
+		}
+		return store.create()
+	}
+	if err != nil {
+		return err
+	}
+
+	file := &encryptedTokenFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return fmt.Errorf("%s is corrupt: %s", store.Path, err)
+	}
+	if file.Version != 1 {
+		return fmt.Errorf("%s was written by a newer version of orchard", store.Path)
+	}
+
+	passphrase, err := store.Passphrase(false)
+	if err != nil {
+		return err
+	}
+	key, err := deriveKey(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return fmt.Errorf("Wrong passphrase for %s", store.Path)
+	}
+	tokens := map[string]string{}
+	if err := json.Unmarshal(plaintext, &tokens); err != nil {
+		return fmt.Errorf("%s is corrupt: %s", store.Path, err)
+	}
+
+	store.file = file
+	store.key = key
+	store.tokens = tokens
+	return nil
+}
+
+func (store *EncryptedFileStore) create() error {
+	passphrase, err := store.Passphrase(true)
+	if err != nil {
+		return err
+	}
+	file := &encryptedTokenFile{Version: 1, Iterations: store.Iterations, Salt: make([]byte, 16)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	key, err := deriveKey(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+
+	store.file = file
+	store.key = key
+	store.tokens = map[string]string{}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the tokens with a new nonce, and replaces the file.
+func (store *EncryptedFileStore) save() error {
+	plaintext, err := json.Marshal(store.tokens)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(store.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	store.file.Nonce = nonce
+	store.file.Data = gcm.Seal(nil, nonce, plaintext, nil)
+
+	data, err := json.Marshal(store.file)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(store.Path), 0700); err != nil {
+		return err
+	}
+	tempPath := store.Path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, store.Path)
+}
+
+func (store *EncryptedFileStore) Get(key TokenKey) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(false); err != nil {
+		return "", err
+	}
+	return store.tokens[key.String()], nil
+}
+
+func (store *EncryptedFileStore) Store(key TokenKey, token string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(true); err != nil {
+		return err
+	}
+	store.tokens[key.String()] = token
+	return store.save()
+}
+
+func (store *EncryptedFileStore) Erase(key TokenKey) error {
+	return store.erase(func(k TokenKey) bool { return k == key })
+}
+
+func (store *EncryptedFileStore) EraseProfile(name string) error {
+	return store.erase(func(k TokenKey) bool { return k.Profile == name })
+}
+
+func (store *EncryptedFileStore) erase(match func(TokenKey) bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(false); err != nil {
+		return err
+	}
+
+	erased := false
+	for s := range store.tokens {
+		if match(parseTokenKey(s)) {
+			delete(store.tokens, s)
+			erased = true
+		}
+	}
+	if !erased {
+		return nil
+	}
+	return store.save()
+}
+
+func (store *EncryptedFileStore) String() string {
+	return store.Path
+}
@@ -0,0 +1,209 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/orchardup/go-orchard/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DefaultAPIURL is used unless a profile or ORCHARD_API_URL says
+// otherwise.
+const DefaultAPIURL = "https://api.orchardup.com/v2"
+
+// Profile is a named set of settings in ~/.orchard/config, for switching
+// between accounts and APIs.
+type Profile struct {
+	Name string `json:"-"`
+
+	// APIURL is the Orchard API to use.
+	APIURL string `json:"api_url,omitempty"`
+
+	// TokenEnv names an environment variable holding the API token. If
+	// it's not set, the token saved by 'orchard login' is used.
+	TokenEnv string `json:"token_env,omitempty"`
+
+	// DefaultHost is the host used when commands aren't given one.
+	DefaultHost string `json:"default_host,omitempty"`
+
+	// HostCA is a file of CA certificates to verify hosts against,
+	// instead of Orchard's own.
+	HostCA string `json:"host_ca,omitempty"`
+}
+
+// Config is the contents of ~/.orchard/config, a JSON file.
+type Config struct {
+	// Current is the profile used when none is selected with --profile
+	// or ORCHARD_PROFILE.
+	Current  string              `json:"current,omitempty"`
+	Profiles map[string]*Profile `json:"profiles,omitempty"`
+
+	// TokenStore names where 'orchard login' saves API tokens; see
+	// GetTokenStore.
+	TokenStore string `json:"token_store,omitempty"`
+}
+
+var validProfileName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Returns an error if name can't be used for a profile.
+func ValidateProfileName(name string) error {
+	if !validProfileName.MatchString(name) {
+		return fmt.Errorf("Invalid profile name %q: use letters, numbers, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+func GetConfigPath() string {
+	return path.Join(os.Getenv("HOME"), ".orchard", "config")
+}
+
+// Reads ~/.orchard/config, which is empty if it doesn't exist yet.
+func LoadConfig() (*Config, error) {
+	config := &Config{}
+	data, err := ioutil.ReadFile(GetConfigPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.UnmarshalStrictJSON(data, config); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", GetConfigPath(), err)
+	}
+	for name, profile := range config.Profiles {
+		profile.Name = name
+	}
+	return config, nil
+}
+
+// Writes the config to ~/.orchard/config.
+func (config *Config) Save() error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	configPath := GetConfigPath()
+	if err := os.MkdirAll(path.Dir(configPath), 0700); err != nil {
+		return err
+	}
+	tempPath := configPath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, configPath)
+}
+
+// Returns the config's profile names, sorted.
+func (config *Config) ProfileNames() []string {
+	names := []string{}
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var currentProfile struct {
+	sync.Mutex
+	profile *Profile
+}
+
+// SelectProfile makes the named profile current, or the one named by
+// ORCHARD_PROFILE or the config's current profile if name is empty. If
+// there isn't one, an empty profile with no name is used, so everything
+// comes from the environment and defaults.
+func SelectProfile(name string) error {
+	profile, err := loadProfile(name)
+	if err != nil {
+		return err
+	}
+	currentProfile.Lock()
+	defer currentProfile.Unlock()
+	currentProfile.profile = profile
+	return nil
+}
+
+func loadProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = os.Getenv("ORCHARD_PROFILE")
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = config.Current
+	}
+	if name == "" {
+		return &Profile{}, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("No profile named %q. See 'orchard profile ls'.", name)
+	}
+	return profile, nil
+}
+
+// CurrentProfile returns the profile selected with SelectProfile, first
+// selecting one from the environment if that hasn't been called.
+func CurrentProfile() (*Profile, error) {
+	currentProfile.Lock()
+	profile := currentProfile.profile
+	currentProfile.Unlock()
+	if profile != nil {
+		return profile, nil
+	}
+
+	if err := SelectProfile(""); err != nil {
+		return nil, err
+	}
+	return CurrentProfile()
+}
+
+// Returns the current profile, or an empty one if it can't be loaded.
+// Commands select the profile when they start, reporting any error then.
+func currentProfileOrEmpty() *Profile {
+	profile, err := CurrentProfile()
+	if err != nil {
+		return &Profile{}
+	}
+	return profile
+}
+
+// Returns the name of the host commands use when they aren't given one:
+// the current profile's default host, or "default".
+func DefaultHostName() string {
+	if host := currentProfileOrEmpty().DefaultHost; host != "" {
+		return host
+	}
+	return "default"
+}
+
+// Returns the current profile's host_ca, the file of CA certificates to
+// verify hosts against, or "" for Orchard's own CA. Pass it to
+// tlsconfig.GetTLSConfig, where ORCHARD_HOST_CA still takes precedence.
+func HostCAFile() string {
+	return currentProfileOrEmpty().HostCA
+}
+
+// Returns the name of the current profile, or "" if none is in use.
+func CurrentProfileName() string {
+	return currentProfileOrEmpty().Name
+}
+
+// Deletes the API tokens saved while the named profile was in use.
+func DeleteProfileTokens(name string) error {
+	store, err := readTokenStore()
+	if err != nil {
+		return err
+	}
+	if err := store.EraseProfile(name); err != nil {
+		return fmt.Errorf("Error deleting API tokens from %s: %s", store, err)
+	}
+	return (&FileStore{}).EraseProfile(name)
+}
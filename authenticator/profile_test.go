@@ -0,0 +1,223 @@
+package authenticator
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Sets HOME to a new directory with the given config, and clears the
+// environment variables that select profiles and tokens. Returns a
+// function that restores them and removes the directory.
+func withConfig(t *testing.T, config *Config) func() {
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"HOME", "ORCHARD_PROFILE", "ORCHARD_TOKEN_STORE", "ORCHARD_API_URL", "ORCHARD_API_TOKEN", "ORCHARD_API_TOKEN_FILE", "ORCHARD_HOST_CA"}
+	saved := map[string]string{}
+	for _, name := range names {
+		saved[name] = os.Getenv(name)
+		os.Setenv(name, "")
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_TOKEN_STORE", FileStoreName)
+
+	reset := func() {
+		tokenStore.name = ""
+		tokenStore.store = nil
+		currentProfile.profile = nil
+	}
+	reset()
+	if err := config.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+		reset()
+		os.RemoveAll(home)
+	}
+}
+
+var testConfig = &Config{
+	Current: "home",
+	Profiles: map[string]*Profile{
+		"home":   {APIURL: "https://home.example.com/v2"},
+		"work":   {APIURL: "https://work.example.com/v2", DefaultHost: "build", HostCA: "/etc/work-ca.pem"},
+		"work-2": {APIURL: "https://work.example.com/v2"},
+	},
+}
+
+func TestSelectProfilePrecedence(t *testing.T) {
+	defer withConfig(t, testConfig)()
+
+	selected := func(flag string) string {
+		if err := SelectProfile(flag); err != nil {
+			t.Fatal(err)
+		}
+		return CurrentProfileName()
+	}
+
+	if name := selected(""); name != "home" {
+		t.Errorf("expected the config's current profile, got %q", name)
+	}
+	os.Setenv("ORCHARD_PROFILE", "work-2")
+	if name := selected(""); name != "work-2" {
+		t.Errorf("expected ORCHARD_PROFILE to beat the current profile, got %q", name)
+	}
+	if name := selected("work"); name != "work" {
+		t.Errorf("expected --profile to beat ORCHARD_PROFILE, got %q", name)
+	}
+	if GetAPIURL() != "https://work.example.com/v2" || DefaultHostName() != "build" {
+		t.Errorf("expected the work profile's settings, got %s and %s", GetAPIURL(), DefaultHostName())
+	}
+	os.Setenv("ORCHARD_API_URL", "https://override.example.com")
+	if GetAPIURL() != "https://override.example.com" {
+		t.Errorf("expected ORCHARD_API_URL to beat the profile, got %s", GetAPIURL())
+	}
+
+	if err := SelectProfile("missing"); err == nil {
+		t.Error("expected an error selecting a missing profile")
+	}
+
+	// Without a config, nothing is selected.
+	os.Setenv("ORCHARD_PROFILE", "")
+	if err := os.Remove(GetConfigPath()); err != nil {
+		t.Fatal(err)
+	}
+	if name := selected(""); name != "" || DefaultHostName() != "default" {
+		t.Errorf("expected no profile, got %q", name)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	defer withConfig(t, testConfig)()
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Profiles["work"].Name != "work" || config.Profiles["work"].HostCA != "/etc/work-ca.pem" {
+		t.Errorf("unexpected work profile: %+v", config.Profiles["work"])
+	}
+
+	if err := ioutil.WriteFile(GetConfigPath(), []byte(`{"profiles": {"work": {"hostca": "/etc/ca.pem"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "hostca") {
+		t.Errorf("expected an error for the unknown key, got %v", err)
+	}
+}
+
+func TestTokenFilesAreKeyedByProfile(t *testing.T) {
+	defer withConfig(t, testConfig)()
+
+	apiURL := "https://work.example.com/v2"
+	paths := map[string]string{}
+	for _, name := range []string{"home", "work", "work-2"} {
+		os.Setenv("ORCHARD_PROFILE", name)
+		if err := SelectProfile(""); err != nil {
+			t.Fatal(err)
+		}
+		tokenFile, err := GetTokenFilePath(apiURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(path.Base(tokenFile), name+"-") {
+			t.Errorf("expected %s's token file to start with its name, got %s", name, tokenFile)
+		}
+		paths[name] = tokenFile
+	}
+
+	// Without a profile, the file is named as earlier versions named it.
+	os.Setenv("ORCHARD_PROFILE", "")
+	if err := os.Remove(GetConfigPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := SelectProfile(""); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile, err := GetTokenFilePath(apiURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tokenHash.MatchString(path.Base(tokenFile)) {
+		t.Errorf("expected an unprefixed token file, got %s", tokenFile)
+	}
+	paths[""] = tokenFile
+
+	for name, tokenFile := range paths {
+		for other, otherFile := range paths {
+			if name != other && otherFile == tokenFile {
+				t.Errorf("%q and %q share the token file %s", name, other, tokenFile)
+			}
+		}
+	}
+}
+
+func TestDeleteProfileTokens(t *testing.T) {
+	defer withConfig(t, testConfig)()
+
+	// "work-2-HASH" also starts with "work-", but isn't work's.
+	apiURL := "https://work.example.com/v2"
+	for _, name := range []string{"home", "work", "work-2"} {
+		if err := SelectProfile(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := SaveToken(apiURL, "token for "+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SelectProfile("work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveToken("https://other.example.com/v2", "other token for work"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteProfileTokens("work"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"home": "token for home", "work": "", "work-2": "token for work-2"} {
+		if err := SelectProfile(name); err != nil {
+			t.Fatal(err)
+		}
+		token, err := SavedToken(apiURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != expected {
+			t.Errorf("profile %q: expected %q, got %q", name, expected, token)
+		}
+	}
+	if err := SelectProfile("work"); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := SavedToken("https://other.example.com/v2"); token != "" {
+		t.Errorf("expected all of work's tokens to be deleted, got %q", token)
+	}
+}
+
+func TestHostCAFile(t *testing.T) {
+	defer withConfig(t, testConfig)()
+
+	// The profile's host_ca applies without selecting it explicitly.
+	os.Setenv("ORCHARD_PROFILE", "work")
+	if caFile := HostCAFile(); caFile != "/etc/work-ca.pem" {
+		t.Errorf("expected the work profile's host_ca, got %q", caFile)
+	}
+
+	// It doesn't stick once another profile is selected.
+	if err := SelectProfile("home"); err != nil {
+		t.Fatal(err)
+	}
+	if caFile := HostCAFile(); caFile != "" {
+		t.Errorf("expected no host_ca for the home profile, got %q", caFile)
+	}
+}
@@ -0,0 +1,95 @@
+package authenticator
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// SecretToolStore keeps tokens in the Secret Service, such as GNOME
+// Keyring or KWallet, by running libsecret's secret-tool command, which
+// talks to it over D-Bus. It doesn't work unless secret-tool is
+// installed, from libsecret-tools on Debian and Ubuntu.
+type SecretToolStore struct{}
+
+// Reports whether there's a D-Bus session to find the Secret Service on,
+// and secret-tool to talk to it with.
+func SecretToolAvailable() bool {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return false
+	}
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") != "" {
+		return true
+	}
+	// Without the variable, libraries look for the bus here.
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		_, err := os.Stat(path.Join(runtimeDir, "bus"))
+		return err == nil
+	}
+	return false
+}
+
+// Items are found by their server attribute, which is unique to each
+// key. The profile attribute lets all of a profile's be erased at once.
+func secretServiceAttributes(key TokenKey) []string {
+	attributes := []string{"service", "orchard", "server", key.String()}
+	if key.Profile != "" {
+		attributes = append(attributes, "profile", key.Profile)
+	}
+	return attributes
+}
+
+// Runs secret-tool, returning its output. It exits with status 1 and no
+// error message when nothing matches, which is reported as found=false.
+func runSecretTool(stdin string, args ...string) (output string, found bool, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if _, ok := err.(*exec.ExitError); ok && message == "" {
+			return "", false, nil
+		}
+		if message != "" {
+			return "", false, fmt.Errorf("secret-tool %s: %s", args[0], message)
+		}
+		return "", false, fmt.Errorf("secret-tool %s: %s", args[0], err)
+	}
+	return stdout.String(), true, nil
+}
+
+func (store *SecretToolStore) Get(key TokenKey) (string, error) {
+	args := append([]string{"lookup"}, secretServiceAttributes(key)...)
+	token, _, err := runSecretTool("", args...)
+	return strings.TrimRight(token, "\n"), err
+}
+
+func (store *SecretToolStore) Store(key TokenKey, token string) error {
+	label := "Orchard API token for " + key.APIURL
+	if key.Profile != "" {
+		label += " (profile " + key.Profile + ")"
+	}
+	args := append([]string{"store", "--label=" + label}, secretServiceAttributes(key)...)
+	_, _, err := runSecretTool(token, args...)
+	return err
+}
+
+func (store *SecretToolStore) Erase(key TokenKey) error {
+	args := append([]string{"clear"}, secretServiceAttributes(key)...)
+	_, _, err := runSecretTool("", args...)
+	return err
+}
+
+func (store *SecretToolStore) EraseProfile(name string) error {
+	_, _, err := runSecretTool("", "clear", "service", "orchard", "profile", name)
+	return err
+}
+
+func (store *SecretToolStore) String() string {
+	return "the Secret Service (through secret-tool)"
+}
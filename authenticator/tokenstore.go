@@ -0,0 +1,311 @@
+package authenticator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// TokenKey identifies a saved API token: the API it's for, and the
+// profile it was saved under, if any.
+type TokenKey struct {
+	APIURL  string
+	Profile string
+}
+
+// Returns the key of the current profile's token for the API at baseURL.
+func CurrentTokenKey(baseURL string) TokenKey {
+	return TokenKey{APIURL: baseURL, Profile: CurrentProfileName()}
+}
+
+// The API URL, with the profile's name after it as a fragment, e.g.
+// https://api.orchardup.com/v2#profile=work. Credential helpers use this
+// as the server URL.
+func (key TokenKey) String() string {
+	if key.Profile == "" {
+		return key.APIURL
+	}
+	return key.APIURL + "#profile=" + key.Profile
+}
+
+func parseTokenKey(s string) TokenKey {
+	i := strings.LastIndex(s, "#profile=")
+	if i < 0 {
+		return TokenKey{APIURL: s}
+	}
+	return TokenKey{APIURL: s[:i], Profile: s[i+len("#profile="):]}
+}
+
+// TokenStore keeps the API tokens saved by 'orchard login'.
+type TokenStore interface {
+	// Get returns the token saved for key, or "" if there isn't one.
+	Get(key TokenKey) (string, error)
+
+	// Store saves token for key, replacing any saved already.
+	Store(key TokenKey, token string) error
+
+	// Erase deletes the token saved for key, if there is one.
+	Erase(key TokenKey) error
+
+	// EraseProfile deletes the tokens saved under the named profile.
+	EraseProfile(name string) error
+
+	// String describes where tokens are kept, for messages.
+	String() string
+}
+
+// Names of the built-in token stores. Any other name is that of a
+// credential helper.
+const (
+	SecretServiceStoreName = "secretservice"
+	EncryptedFileStoreName = "encrypted-file"
+	FileStoreName          = "file"
+)
+
+var tokenStore struct {
+	sync.Mutex
+	name  string
+	store TokenStore
+}
+
+// ErrNoTokenStore is returned by TokenStoreName if no token store has
+// been chosen and there's no Secret Service to default to. Tokens are
+// only saved in plaintext if that's asked for.
+var ErrNoTokenStore = fmt.Errorf("There's no Secret Service to save API tokens in, as secret-tool isn't installed or there's no D-Bus session. Choose where to save them with ORCHARD_TOKEN_STORE, or token_store in ~/.orchard/config: %s, %s (plaintext), or the name of a credential helper (see 'orchard login -h').", EncryptedFileStoreName, FileStoreName)
+
+// TokenStoreName returns the name of the token store to use: the one
+// named by ORCHARD_TOKEN_STORE or by token_store in ~/.orchard/config,
+// or else the Secret Service if there is one. Otherwise it returns
+// ErrNoTokenStore.
+func TokenStoreName() (string, error) {
+	tokenStore.Lock()
+	defer tokenStore.Unlock()
+	return tokenStoreName()
+}
+
+func tokenStoreName() (string, error) {
+	if tokenStore.name != "" {
+		return tokenStore.name, nil
+	}
+
+	name := os.Getenv("ORCHARD_TOKEN_STORE")
+	if name == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			return "", err
+		}
+		name = config.TokenStore
+	}
+	if name == "" {
+		if !SecretToolAvailable() {
+			return "", ErrNoTokenStore
+		}
+		name = SecretServiceStoreName
+	}
+	tokenStore.name = name
+	return name, nil
+}
+
+// GetTokenStore returns the token store named by TokenStoreName.
+func GetTokenStore() (TokenStore, error) {
+	tokenStore.Lock()
+	defer tokenStore.Unlock()
+	if tokenStore.store != nil {
+		return tokenStore.store, nil
+	}
+
+	name, err := tokenStoreName()
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewTokenStore(name)
+	if err != nil {
+		return nil, err
+	}
+	tokenStore.store = store
+	return store, nil
+}
+
+// Returns the token store to read and delete tokens in. If there's none
+// to save them in, that's the plaintext files that earlier versions saved
+// them in, which are only read, never written.
+func readTokenStore() (TokenStore, error) {
+	store, err := GetTokenStore()
+	if err == ErrNoTokenStore {
+		return &FileStore{}, nil
+	}
+	return store, err
+}
+
+// Reports whether reading saved tokens may mean asking for a passphrase,
+// which background processes can't do.
+func TokenStoreNeedsPassphrase() (bool, error) {
+	name, err := TokenStoreName()
+	if err == ErrNoTokenStore {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return name == EncryptedFileStoreName && os.Getenv("ORCHARD_TOKEN_PASSPHRASE") == "", nil
+}
+
+// BackgroundEnv returns environment variables for a background orchard
+// process started from this one, so that it uses the same token store
+// without prompting. If the store needs a passphrase that isn't in the
+// environment, the process is given the token for the API at baseURL
+// instead, which it can't replace if the API rejects it. If there's no
+// token store, it reads tokens as this process does, so nothing is
+// passed on.
+func BackgroundEnv(baseURL string) ([]string, error) {
+	name, err := TokenStoreName()
+	if err == ErrNoTokenStore {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	env := []string{"ORCHARD_TOKEN_STORE=" + name}
+
+	needsPassphrase, err := TokenStoreNeedsPassphrase()
+	if err != nil || !needsPassphrase {
+		return env, err
+	}
+	token, err := Token(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		env = append(env, "ORCHARD_API_TOKEN="+token)
+	}
+	return env, nil
+}
+
+// NewTokenStore returns the named token store. Names other than the
+// built-in ones are those of credential helpers: programs in the PATH
+// called orchard-credential-NAME.
+func NewTokenStore(name string) (TokenStore, error) {
+	switch name {
+	case SecretServiceStoreName:
+		return &SecretToolStore{}, nil
+	case EncryptedFileStoreName:
+		return NewEncryptedFileStore(GetEncryptedTokenFilePath()), nil
+	case FileStoreName:
+		return &FileStore{}, nil
+	}
+
+	helper := &CredentialHelperStore{Name: name}
+	if _, err := exec.LookPath(helper.Program()); err != nil {
+		return nil, fmt.Errorf("Unknown token store %q: it isn't %s, %s or %s, and there's no credential helper called %s in your PATH.", name, SecretServiceStoreName, EncryptedFileStoreName, FileStoreName, helper.Program())
+	}
+	return helper, nil
+}
+
+// Moves a token that an earlier version saved in a plaintext file into
+// store, returning it, or "" if there isn't one. What happened is passed
+// to notify, unless it's nil.
+func migrateToken(store TokenStore, key TokenKey, notify func(message string)) (string, error) {
+	if notify == nil {
+		notify = func(string) {}
+	}
+
+	if _, ok := store.(*FileStore); ok {
+		return "", nil
+	}
+
+	fileStore := &FileStore{}
+	token, err := fileStore.Get(key)
+	if err != nil || token == "" {
+		return "", err
+	}
+
+	// The token still works from the file, so failing to move it
+	// shouldn't stop anything. It's tried again next time.
+	if err := store.Store(key, token); err != nil {
+		notify(fmt.Sprintf("Warning: couldn't move your API token out of %s and into %s: %s", fileStore, store, err))
+		return token, nil
+	}
+	if err := fileStore.Erase(key); err != nil {
+		return "", err
+	}
+	notify(fmt.Sprintf("Moved your API token for %s out of %s and into %s.", key.APIURL, fileStore, store))
+	return token, nil
+}
+
+// FileStore keeps tokens in plaintext files in ~/.orchard/api_tokens,
+// readable only by you, where earlier versions always saved them. It's
+// only used if it's chosen.
+type FileStore struct{}
+
+func (store *FileStore) Get(key TokenKey) (string, error) {
+	tokenFile, err := getTokenFilePath(key)
+	if err != nil {
+		return "", err
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+func (store *FileStore) Store(key TokenKey, token string) error {
+	tokenFile, err := getTokenFilePath(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte(token), 0600); err != nil {
+		return err
+	}
+	// WriteFile leaves the mode of an existing file alone, and earlier
+	// versions saved tokens readable by everyone.
+	return os.Chmod(tokenFile, 0600)
+}
+
+func (store *FileStore) Erase(key TokenKey) error {
+	tokenFile, err := getTokenFilePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(tokenFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (store *FileStore) EraseProfile(name string) error {
+	tokenDir, err := GetTokenDir()
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(tokenDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		// Tokens are saved as NAME-HASH, and other profiles' names can
+		// start with NAME- too.
+		hash := strings.TrimPrefix(file.Name(), name+"-")
+		if hash == file.Name() || !tokenHash.MatchString(hash) {
+			continue
+		}
+		if err := os.Remove(path.Join(tokenDir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+var tokenHash = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func (store *FileStore) String() string {
+	return "~/.orchard/api_tokens"
+}
@@ -0,0 +1,423 @@
+package authenticator
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orchard-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := path.Join(dir, "api_tokens.enc")
+	newStore := func(passphrase string) *EncryptedFileStore {
+		store := NewEncryptedFileStore(tokenFile)
+		store.Iterations = 1000
+		store.Passphrase = func(isNew bool) (string, error) {
+			if isNew && passphrase == "wrong" {
+				t.Error("asked for a new passphrase for an existing file")
+			}
+			return passphrase, nil
+		}
+		return store
+	}
+
+	store := newStore("")
+	store.Passphrase = func(isNew bool) (string, error) {
+		t.Error("asked for a passphrase before there were any tokens")
+		return "", nil
+	}
+	if token, err := store.Get(TokenKey{APIURL: "https://api"}); err != nil || token != "" {
+		t.Fatalf("expected no token, got %q, %v", token, err)
+	}
+
+	store = newStore("secret")
+	keys := []TokenKey{{APIURL: "https://api"}, {APIURL: "https://api", Profile: "work"}}
+	for _, key := range keys {
+		if err := store.Store(key, "token for "+key.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "token for") {
+		t.Errorf("tokens were saved unencrypted: %s", data)
+	}
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	store = newStore("secret")
+	for _, key := range keys {
+		token, err := store.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "token for "+key.String() {
+			t.Errorf("expected the token for %s, got %q", key, token)
+		}
+	}
+
+	if _, err := newStore("wrong").Get(keys[0]); err == nil || !strings.Contains(err.Error(), "Wrong passphrase") {
+		t.Errorf("expected a wrong passphrase error, got %v", err)
+	}
+
+	if err := store.EraseProfile("work"); err != nil {
+		t.Fatal(err)
+	}
+	store = newStore("secret")
+	if token, _ := store.Get(keys[0]); token == "" {
+		t.Error("erasing a profile's tokens erased another's")
+	}
+	if token, _ := store.Get(keys[1]); token != "" {
+		t.Errorf("expected the profile's token to be erased, got %q", token)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vectors.
+	for iterations, expected := range map[int]string{
+		1:    "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		4096: "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a",
+	} {
+		key, err := deriveKey("password", []byte("salt"), iterations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != expected {
+			t.Errorf("%d iterations: expected %s, got %x", iterations, expected, key)
+		}
+	}
+	if _, err := deriveKey("password", []byte("salt"), 0); err == nil {
+		t.Error("expected an error for no iterations")
+	}
+}
+
+// A credential helper that keeps what it's given in files named after
+// the server URL's hash.
+const testCredentialHelper = `#!/bin/sh
+dir="$(dirname "$0")/credentials"
+mkdir -p "$dir"
+file() { printf %s "$1" | md5sum | cut -c1-32; }
+case "$1" in
+store)
+	input=$(cat)
+	url=$(printf %s "$input" | sed 's/.*"ServerURL":"\([^"]*\)".*/\1/')
+	printf %s "$input" > "$dir/$(file "$url")" ;;
+get|erase)
+	url=$(cat)
+	f="$dir/$(file "$url")"
+	if [ ! -f "$f" ]; then echo "credentials not found in native keychain"; exit 1; fi
+	if [ "$1" = get ]; then cat "$f"; else rm "$f"; fi ;;
+list)
+	sep=""
+	printf "{"
+	for f in "$dir"/*; do
+		[ -f "$f" ] || continue
+		url=$(sed 's/.*"ServerURL":"\([^"]*\)".*/\1/' "$f")
+		printf '%s"%s":"token"' "$sep" "$url"
+		sep=","
+	done
+	printf "}" ;;
+esac
+`
+
+func TestCredentialHelperStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orchard-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "orchard-credential-test"), []byte(testCredentialHelper), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	store, err := NewTokenStore("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTokenStore("missing"); err == nil {
+		t.Error("expected an error for a helper that isn't installed")
+	}
+
+	key := TokenKey{APIURL: "https://api", Profile: "work"}
+	if token, err := store.Get(key); err != nil || token != "" {
+		t.Fatalf("expected no token, got %q, %v", token, err)
+	}
+	if err := store.Store(key, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store(TokenKey{APIURL: "https://api"}, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := store.Get(key); err != nil || token != "secret" {
+		t.Fatalf("expected the stored token, got %q, %v", token, err)
+	}
+
+	if err := store.EraseProfile("work"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := store.Get(key); err != nil || token != "" {
+		t.Errorf("expected the profile's token to be erased, got %q, %v", token, err)
+	}
+	if token, _ := store.Get(TokenKey{APIURL: "https://api"}); token != "other" {
+		t.Errorf("erasing a profile's tokens erased another's")
+	}
+	if err := store.Erase(key); err != nil {
+		t.Errorf("expected erasing a missing token to succeed, got %v", err)
+	}
+}
+
+func TestSavedTokenMigratesPlaintextFile(t *testing.T) {
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, name := range []string{"HOME", "ORCHARD_TOKEN_STORE", "ORCHARD_TOKEN_PASSPHRASE", "ORCHARD_PROFILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_TOKEN_STORE", EncryptedFileStoreName)
+	os.Setenv("ORCHARD_TOKEN_PASSPHRASE", "secret")
+	os.Setenv("ORCHARD_PROFILE", "")
+
+	reset := func() {
+		tokenStore.name = ""
+		tokenStore.store = nil
+		currentProfile.profile = nil
+	}
+	reset()
+	defer reset()
+
+	baseURL := "https://api"
+	tokenFile, err := GetTokenFilePath(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := SavedToken(baseURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "old" {
+			t.Errorf("expected the plaintext token, got %q", token)
+		}
+		if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+			t.Errorf("expected the plaintext file to be removed, got %v", err)
+		}
+	}
+	if _, err := os.Stat(GetEncryptedTokenFilePath()); err != nil {
+		t.Errorf("expected the token to be moved to the encrypted file: %v", err)
+	}
+
+	if err := DeleteToken(baseURL); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := SavedToken(baseURL); err != nil || token != "" {
+		t.Errorf("expected no token after deleting it, got %q, %v", token, err)
+	}
+}
+
+func TestDefaultTokenStore(t *testing.T) {
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, name := range []string{"HOME", "PATH", "ORCHARD_TOKEN_STORE", "ORCHARD_TOKEN_PASSPHRASE", "ORCHARD_API_TOKEN", "ORCHARD_API_TOKEN_FILE", "ORCHARD_PROFILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("PATH", home)
+	os.Setenv("ORCHARD_TOKEN_STORE", "")
+	os.Setenv("ORCHARD_TOKEN_PASSPHRASE", "")
+	os.Setenv("ORCHARD_API_TOKEN", "")
+	os.Setenv("ORCHARD_API_TOKEN_FILE", "")
+	os.Setenv("ORCHARD_PROFILE", "")
+
+	reset := func() {
+		tokenStore.name = ""
+		tokenStore.store = nil
+		currentProfile.profile = nil
+	}
+	reset()
+	defer reset()
+
+	// Without a Secret Service, plaintext files are only used if they're
+	// asked for, though tokens earlier versions saved in them are read.
+	if name, err := TokenStoreName(); err != ErrNoTokenStore {
+		t.Errorf("expected ErrNoTokenStore without a Secret Service, got %q, %v", name, err)
+	}
+	if err := SaveToken("https://api", "saved"); err != ErrNoTokenStore {
+		t.Errorf("expected saving to fail with ErrNoTokenStore, got %v", err)
+	}
+	tokenFile, err := GetTokenFilePath("https://api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := SavedToken("https://api"); err != nil || token != "old" {
+		t.Errorf("expected the plaintext token to be read, got %q, %v", token, err)
+	}
+	if env, err := BackgroundEnv("https://api"); err != nil || len(env) != 0 {
+		t.Errorf("expected nothing to be passed on, got %q, %v", env, err)
+	}
+	if err := DeleteToken("https://api"); err != nil {
+		t.Fatal(err)
+	}
+
+	reset()
+	os.Setenv("ORCHARD_TOKEN_STORE", FileStoreName)
+	if env, err := BackgroundEnv("https://api"); err != nil || len(env) != 1 || env[0] != "ORCHARD_TOKEN_STORE=file" {
+		t.Errorf("expected only the token store to be passed on, got %q, %v", env, err)
+	}
+
+	reset()
+	os.Setenv("ORCHARD_TOKEN_STORE", EncryptedFileStoreName)
+	os.Setenv("ORCHARD_TOKEN_PASSPHRASE", "secret")
+	if err := SaveToken("https://api", "saved"); err != nil {
+		t.Fatal(err)
+	}
+	if env, err := BackgroundEnv("https://api"); err != nil || len(env) != 1 {
+		t.Errorf("expected the passphrase to be enough, got %q, %v", env, err)
+	}
+
+	// With the store unlocked but no passphrase to pass on, background
+	// processes get the token itself.
+	os.Setenv("ORCHARD_TOKEN_PASSPHRASE", "")
+	env, err := BackgroundEnv("https://api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 2 || env[0] != "ORCHARD_TOKEN_STORE=encrypted-file" || env[1] != "ORCHARD_API_TOKEN=saved" {
+		t.Errorf("expected the token to be passed on, got %q", env)
+	}
+}
+
+func TestNonInteractiveToken(t *testing.T) {
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, name := range []string{"HOME", "ORCHARD_TOKEN_STORE", "ORCHARD_TOKEN_PASSPHRASE", "ORCHARD_API_TOKEN", "ORCHARD_API_TOKEN_FILE", "ORCHARD_PROFILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_TOKEN_STORE", EncryptedFileStoreName)
+	os.Setenv("ORCHARD_TOKEN_PASSPHRASE", "")
+	os.Setenv("ORCHARD_API_TOKEN", "")
+	os.Setenv("ORCHARD_API_TOKEN_FILE", "")
+	os.Setenv("ORCHARD_PROFILE", "")
+
+	reset := func() {
+		tokenStore.name = ""
+		tokenStore.store = nil
+		currentProfile.profile = nil
+	}
+	reset()
+	defer reset()
+
+	// Nothing may be written to the terminal.
+	stderr, err := ioutil.TempFile(home, "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *os.File) { os.Stderr = saved }(os.Stderr)
+	os.Stderr = stderr
+
+	// A token an earlier version saved in a plaintext file is still read,
+	// though it can't be moved into the encrypted file.
+	baseURL := "https://api"
+	tokenFile, err := GetTokenFilePath(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := NonInteractiveToken(baseURL); err != nil || token != "old" {
+		t.Errorf("expected the plaintext token, got %q, %v", token, err)
+	}
+
+	// Once it's moved, it can't be read without the passphrase.
+	os.Setenv("ORCHARD_TOKEN_PASSPHRASE", "secret")
+	if token, err := NonInteractiveToken(baseURL); err != nil || token != "old" {
+		t.Errorf("expected the moved token, got %q, %v", token, err)
+	}
+	if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+		t.Errorf("expected the plaintext file to be removed, got %v", err)
+	}
+	os.Setenv("ORCHARD_TOKEN_PASSPHRASE", "")
+	if token, err := NonInteractiveToken(baseURL); err != ErrPassphraseRequired || token != "" {
+		t.Errorf("expected ErrPassphraseRequired, got %q, %v", token, err)
+	}
+
+	if output, err := ioutil.ReadFile(stderr.Name()); err != nil || len(output) != 0 {
+		t.Errorf("expected nothing on stderr, got %q, %v", output, err)
+	}
+}
+
+func TestFileStoreFixesMode(t *testing.T) {
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, name := range []string{"HOME", "ORCHARD_PROFILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_PROFILE", "")
+	currentProfile.profile = nil
+	defer func() { currentProfile.profile = nil }()
+
+	key := TokenKey{APIURL: "https://api"}
+	tokenFile, err := getTokenFilePath(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(tokenFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&FileStore{}).Store(key, "new"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the token file to be readable only by its owner, got %v", info.Mode())
+	}
+	if token, err := (&FileStore{}).Get(key); err != nil || token != "new" {
+		t.Errorf("expected the new token, got %q, %v", token, err)
+	}
+}
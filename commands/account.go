@@ -0,0 +1,239 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/authenticator"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var Login = &Command{
+	UsageLine: "login [--username USERNAME] [--password-stdin]",
+	Short:     "Log in to Orchard",
+	Long: `Log in to Orchard, saving an API token for other commands to use.
+Logging in again replaces the saved token, so this is how to switch
+accounts.
+
+You're prompted for your username and password, unless you set
+--username, and --password-stdin to read the password from stdin:
+
+    $ echo "$ORCHARD_PASSWORD" | orchard login --username you --password-stdin
+
+ORCHARD_USERNAME and ORCHARD_PASSWORD_FILE, the path of a file holding the
+password, work in place of those. Any command logs in with them if it
+needs to. Without a terminal to prompt on, commands fail rather than
+waiting for input.
+
+If the API stops accepting the saved token because it has expired or been
+revoked, commands delete it and ask you to log in again, once.
+
+The token is for the API at ORCHARD_API_URL, or the current profile's, or
+Orchard's own. Each profile has its own saved token (see 'orchard profile').
+If ORCHARD_API_TOKEN is set, or ORCHARD_API_TOKEN_FILE to the path of a file
+holding a token, commands use it instead of the saved token.
+
+Tokens are saved in the token store named by ORCHARD_TOKEN_STORE, or by
+token_store in ~/.orchard/config:
+
+  secretservice    The Secret Service, such as GNOME Keyring, through
+                   libsecret's secret-tool command, which must be
+                   installed (it's in libsecret-tools on Debian and
+                   Ubuntu); the default if it is
+  file             Plaintext files in ~/.orchard/api_tokens, readable
+                   only by you
+  encrypted-file   ~/.orchard/api_tokens.enc, encrypted with a passphrase
+                   from ORCHARD_TOKEN_PASSPHRASE or that you're asked for
+                   once per command
+  NAME             A credential helper called orchard-credential-NAME,
+                   which works like Docker's credential helpers
+
+Without a Secret Service, you need to choose one of the others, as tokens
+are only saved in plaintext if you ask for that. Tokens that earlier
+versions saved in ~/.orchard/api_tokens are still read until you do, and
+then moved into the token store, if it's another one, when they're first
+used.
+
+Background proxies can't ask for the encrypted file's passphrase, so
+'orchard proxy start -d' passes them the token instead, unless
+ORCHARD_TOKEN_PASSPHRASE is set. Proxies run by systemd need another token
+store, or ORCHARD_API_TOKEN_FILE.
+`,
+}
+
+var Logout = &Command{
+	UsageLine: "logout",
+	Short:     "Log out of Orchard",
+	Long: `Log out of Orchard, revoking the saved API token if the API supports it,
+and deleting it.
+`,
+}
+
+var Whoami = &Command{
+	UsageLine: "whoami [--format FORMAT]",
+	Short:     "Show who you're logged in as",
+	Long: `Show the user you're logged in as, and the Orchard API in use. Exits
+with an error if you aren't logged in; you're never prompted to.
+
+` + formatUsage,
+}
+
+var flLoginUsername = Login.Flag.String("username", "", "")
+var flLoginPasswordStdin = Login.Flag.Bool("password-stdin", false, "")
+
+var flWhoamiFormat = FormatFlag(Whoami)
+
+func init() {
+	Login.Run = RunLogin
+	Logout.Run = RunLogout
+	Whoami.Run = RunWhoami
+}
+
+// The user printed by 'orchard whoami'.
+type WhoamiInfo struct {
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+	APIURL   string `json:"api_url"`
+}
+
+func RunLogin(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard login` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	// Don't ask for credentials when the token can't be saved.
+	if _, err := authenticator.GetTokenStore(); err != nil {
+		return err
+	}
+	username := *flLoginUsername
+	if username == "" {
+		username = os.Getenv("ORCHARD_USERNAME")
+	}
+	if *flLoginPasswordStdin && username == "" {
+		return cmd.UsageError("--password-stdin needs --username or ORCHARD_USERNAME")
+	}
+
+	if username == "" {
+		var err error
+		username, err = authenticator.PromptUsername(ctx)
+		if err == authenticator.ErrNoTerminal {
+			return errors.New("There's no terminal to ask for your username on. Use --username, or set ORCHARD_USERNAME.")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var password string
+	if *flLoginPasswordStdin {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	} else if passwordFile := os.Getenv("ORCHARD_PASSWORD_FILE"); passwordFile != "" {
+		var err error
+		password, err = authenticator.ReadPasswordFile(passwordFile)
+		if err != nil {
+			return fmt.Errorf("Error reading ORCHARD_PASSWORD_FILE: %s", err)
+		}
+	} else {
+		var err error
+		password, err = authenticator.PromptPassword()
+		if err == authenticator.ErrNoTerminal {
+			return errors.New("There's no terminal to ask for your password on. Use --password-stdin, or set ORCHARD_PASSWORD_FILE.")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	httpClient := api.NewHTTPClient(authenticator.GetAPIURL(), "")
+	if err := authenticator.Login(ctx, httpClient, username, password); err != nil {
+		if api.IsUnauthorized(err) || api.IsInvalid(err) {
+			return errors.New("Login failed: wrong username or password")
+		}
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Logged in as %s at %s\n", username, httpClient.BaseURL)
+	for _, name := range []string{"ORCHARD_API_TOKEN", "ORCHARD_API_TOKEN_FILE"} {
+		if os.Getenv(name) != "" {
+			fmt.Fprintf(os.Stderr, "%s is set, so commands will use it instead until you unset it.\n", name)
+		}
+	}
+	return nil
+}
+
+func RunLogout(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard logout` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+
+	apiURL := authenticator.GetAPIURL()
+	token, err := authenticator.SavedToken(apiURL)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "Not logged in at %s\n", apiURL)
+		return nil
+	}
+
+	// The token is deleted even if it can't be revoked, so that it isn't
+	// used again from here.
+	httpClient := api.NewHTTPClient(apiURL, token)
+	if _, err := httpClient.RevokeTokenContext(ctx); err != nil && !api.IsUnauthorized(err) {
+		fmt.Fprintf(os.Stderr, "Error revoking API token: %s\n", err)
+	}
+	if err := authenticator.DeleteToken(apiURL); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Logged out of %s\n", apiURL)
+	for _, name := range []string{"ORCHARD_API_TOKEN", "ORCHARD_API_TOKEN_FILE"} {
+		if os.Getenv(name) != "" {
+			fmt.Fprintf(os.Stderr, "%s is still set, so commands will keep using it.\n", name)
+		}
+	}
+	return nil
+}
+
+func RunWhoami(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard whoami` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	if err := ValidateFormat(*flWhoamiFormat); err != nil {
+		return err
+	}
+
+	apiURL := authenticator.GetAPIURL()
+	token, err := authenticator.Token(apiURL)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("Not logged in at %s. Run 'orchard login' to log in.", apiURL)
+	}
+
+	account, err := api.NewHTTPClient(apiURL, token).GetAccountContext(ctx)
+	if api.IsUnauthorized(err) {
+		return fmt.Errorf("Your API token for %s is no longer valid. Run 'orchard login' to log in again.", apiURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	info := &WhoamiInfo{Username: account.Username, Email: account.Email, APIURL: apiURL}
+	return WriteOutput(os.Stdout, *flWhoamiFormat, info, func(w io.Writer) error {
+		if info.Email != "" {
+			_, err := fmt.Fprintf(w, "%s <%s> at %s\n", info.Username, info.Email, info.APIURL)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s at %s\n", info.Username, info.APIURL)
+		return err
+	})
+}
@@ -0,0 +1,327 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/proxy"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// HostProxies serves a proxy for each of an account's hosts, on a Unix
+// socket at ~/.orchard/run/HOST.sock, and keeps the set of proxies in
+// step with the account's hosts as they're created and removed.
+type HostProxies struct {
+	HTTPClient *api.HTTPClient
+	RunDir     string
+
+	// Applied to each proxy.
+	Logger              *proxy.RequestLogger
+	Policy              *proxy.Policy
+	HealthCheckInterval time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*proxiedHost
+}
+
+type proxiedHost struct {
+	upstream *proxy.Upstream
+
+	// nil if the host's socket belongs to another proxy, such as one
+	// started with 'orchard proxy start'.
+	proxy      *proxy.Proxy
+	socketPath string
+
+	// The socket file this proxy created. A host removed and added again
+	// gets a new proxy listening at the same path, possibly before this
+	// one has finished stopping, so the path is only removed if it's
+	// still this file.
+	socketFile os.FileInfo
+
+	// The host's lock, held while the proxy runs, as 'orchard proxy
+	// start' holds it, so that the two don't serve the same socket.
+	lock       *os.File
+	pidFile    string
+	statusFile string
+}
+
+// Refresh fetches the account's hosts, starting proxies for new ones and
+// stopping proxies for ones that have been removed. Hosts that are still
+// being created are picked up once they're running.
+func (hp *HostProxies) Refresh(ctx context.Context) error {
+	hosts, err := hp.HTTPClient.GetHostsContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	if hp.hosts == nil {
+		hp.hosts = make(map[string]*proxiedHost)
+	}
+
+	current := make(map[string]bool)
+	for _, host := range hosts {
+		if host.Status == api.HostCreating || host.Status == api.HostError {
+			continue
+		}
+		current[host.Name] = true
+		if _, ok := hp.hosts[host.Name]; ok {
+			continue
+		}
+		started, err := hp.start(host)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting proxy for %s: %s\n", GetHumanHostName(host.Name), err)
+			continue
+		}
+		hp.hosts[host.Name] = started
+	}
+
+	for name, proxied := range hp.hosts {
+		if !current[name] {
+			delete(hp.hosts, name)
+			go hp.stop(name, proxied)
+		}
+	}
+
+	return nil
+}
+
+func (hp *HostProxies) start(host *api.Host) (*proxiedHost, error) {
+	dialFunc, err := DockerDialFunc(host)
+	if err != nil {
+		return nil, err
+	}
+	started := &proxiedHost{
+		upstream:   &proxy.Upstream{Name: host.Name, DialFunc: dialFunc},
+		socketPath: path.Join(hp.RunDir, host.Name+".sock"),
+		pidFile:    path.Join(hp.RunDir, host.Name+".pid"),
+		statusFile: path.Join(hp.RunDir, host.Name+".status"),
+	}
+
+	// Until the lock is held, the socket may be another proxy's.
+	lock, err := lockProxy(hp.RunDir, host.Name)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		fmt.Fprintf(os.Stderr, "Using the running proxy for %s at unix://%s\n", GetHumanHostName(host.Name), started.socketPath)
+		return started, nil
+	}
+
+	// Left behind by a proxy that didn't exit cleanly.
+	os.Remove(started.socketPath)
+	os.Remove(started.statusFile)
+
+	p := proxy.New(
+		func() (net.Listener, error) {
+			listener, err := net.Listen("unix", started.socketPath)
+			if err != nil {
+				return nil, err
+			}
+			// Otherwise closing it removes whatever is at the path by
+			// then; stop removes it only if it's still ours.
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			started.socketFile, err = os.Stat(started.socketPath)
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+			return listener, nil
+		},
+		dialFunc,
+	)
+	p.Logger = hp.Logger
+	p.Policy = hp.Policy
+	p.HealthCheckInterval = hp.HealthCheckInterval
+	p.OnHealthChange = func(status proxy.HealthStatus) {
+		ReportHealth(host.Name, status)
+		if err := WriteHealthStatus(started.statusFile, status); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing status for %s: %s\n", GetHumanHostName(host.Name), err)
+		}
+	}
+	if err := p.Listen(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	// With the pidfile written, 'orchard docker' and the like use this
+	// proxy rather than starting their own.
+	if err := writePidFile(started.pidFile); err != nil {
+		p.Shutdown(context.Background())
+		os.Remove(started.socketPath)
+		lock.Close()
+		return nil, err
+	}
+	go func() {
+		if err := p.Serve(context.Background()); err != nil && err != proxy.ErrProxyClosed {
+			fmt.Fprintf(os.Stderr, "Proxy for %s stopped with error: %v\n", GetHumanHostName(host.Name), err)
+		}
+	}()
+
+	started.proxy = p
+	started.lock = lock
+	fmt.Fprintf(os.Stderr, "Started proxy for %s at unix://%s\n", GetHumanHostName(host.Name), started.socketPath)
+	return started, nil
+}
+
+func (hp *HostProxies) stop(name string, proxied *proxiedHost) {
+	if proxied.proxy == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ProxyShutdownTimeout)
+	defer cancel()
+	proxied.proxy.Shutdown(ctx)
+	if info, err := os.Stat(proxied.socketPath); err == nil && os.SameFile(info, proxied.socketFile) {
+		os.Remove(proxied.socketPath)
+	}
+	// Another proxy can only write these once the lock is released.
+	os.Remove(proxied.pidFile)
+	os.Remove(proxied.statusFile)
+	proxied.lock.Close()
+	fmt.Fprintf(os.Stderr, "Stopped proxy for %s\n", GetHumanHostName(name))
+}
+
+// Upstream returns the host with the given name, or nil if there isn't
+// one.
+func (hp *HostProxies) Upstream(name string) *proxy.Upstream {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	if proxied, ok := hp.hosts[name]; ok {
+		return proxied.upstream
+	}
+	return nil
+}
+
+// Proxies returns the proxies being served, by host name. Hosts whose
+// sockets belong to other proxies aren't included.
+func (hp *HostProxies) Proxies() map[string]*proxy.Proxy {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	proxies := make(map[string]*proxy.Proxy)
+	for name, proxied := range hp.hosts {
+		if proxied.proxy != nil {
+			proxies[name] = proxied.proxy
+		}
+	}
+	return proxies
+}
+
+// Shutdown stops all the proxies, waiting for their connections to
+// finish.
+func (hp *HostProxies) Shutdown() {
+	hp.mu.Lock()
+	hosts := hp.hosts
+	hp.hosts = nil
+	hp.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, proxied := range hosts {
+		wg.Add(1)
+		go func(name string, proxied *proxiedHost) {
+			defer wg.Done()
+			hp.stop(name, proxied)
+		}(name, proxied)
+	}
+	wg.Wait()
+}
+
+// Serves proxies for all hosts until the context is done, checking for
+// new and removed hosts every refreshInterval. If listenURL is set, it's
+// also listened on, with requests routed to hosts by a "/hosts/NAME/"
+// path prefix or the X-Orchard-Host header.
+func RunAllProxies(ctx context.Context, listenURL string, opts *ProxyOptions, refreshInterval time.Duration) error {
+	httpClient, err := authenticator.Authenticate(ctx)
+	if err != nil {
+		return err
+	}
+
+	runDir, err := GetRunDir()
+	if err != nil {
+		return err
+	}
+
+	// The options are applied once and shared, so that there's a single
+	// log file.
+	// Metrics for all hosts are served together, below.
+	shared := *opts
+	shared.MetricsAddr = ""
+	options := &proxy.Proxy{}
+	closeOptions, err := shared.Apply(options, "")
+	if err != nil {
+		return fmt.Errorf("Error starting proxy: %v", err)
+	}
+	defer closeOptions()
+
+	proxies := &HostProxies{
+		HTTPClient: httpClient,
+		RunDir:     runDir,
+		Logger:     options.Logger,
+		Policy:     options.Policy,
+
+		HealthCheckInterval: options.HealthCheckInterval,
+	}
+	if err := proxies.Refresh(ctx); err != nil {
+		return err
+	}
+	defer proxies.Shutdown()
+
+	if opts.MetricsAddr != "" {
+		stopMetrics, err := ServeMetrics(opts.MetricsAddr, proxies.Proxies)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	if listenURL != "" {
+		listenType, listenAddr, err := ListenArgs(listenURL)
+		if err != nil {
+			return err
+		}
+
+		router := proxy.New(ListenFunc(listenType, listenAddr), nil)
+		router.Route = proxy.RouteByHost("default", proxies.Upstream)
+		router.Logger = options.Logger
+		router.Policy = options.Policy
+		router.AuthToken = opts.AuthToken
+		if err := opts.secureListener(router); err != nil {
+			return err
+		}
+		if err := router.Listen(); err != nil {
+			return fmt.Errorf("Error starting proxy: %v", err)
+		}
+		go func() {
+			if err := router.Serve(context.Background()); err != nil && err != proxy.ErrProxyClosed {
+				fmt.Fprintf(os.Stderr, "Proxy stopped with error: %v\n", err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), ProxyShutdownTimeout)
+			defer cancel()
+			router.Shutdown(shutdownCtx)
+		}()
+
+		fmt.Fprintf(os.Stderr, "Routing requests to hosts at %s, by /hosts/NAME/ path prefix or X-Orchard-Host header\n", listenURL)
+		PrintProxyUsage(listenURL, opts)
+	}
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr, "\nStopping proxies")
+			return nil
+		case <-ticker.C:
+			if err := proxies.Refresh(ctx); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Error refreshing hosts: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHostProxiesTakeLocks(t *testing.T) {
+	runDir, cleanup := withTempHome(t)
+	defer cleanup()
+
+	cert, key, err := tlsconfig.GenerateCA("Test Client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]string{
+			{"name": "web", "ipv4_address": "127.0.0.1", "client_cert": string(cert), "client_key": string(key)},
+			{"name": "db", "ipv4_address": "127.0.0.1", "client_cert": string(cert), "client_key": string(key)},
+		})
+	}))
+	defer ts.Close()
+
+	// web's proxy is already running, so its socket is left alone.
+	lock, err := lockProxy(runDir, "web")
+	if err != nil || lock == nil {
+		t.Fatalf("expected to take the lock, got %v", err)
+	}
+	defer lock.Close()
+	webSocket := path.Join(runDir, "web.sock")
+	if err := ioutil.WriteFile(webSocket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxies := &HostProxies{HTTPClient: &api.HTTPClient{BaseURL: ts.URL, Token: "token"}, RunDir: runDir}
+	if err := proxies.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proxies.Proxies()["web"]; ok {
+		t.Error("expected web to be left to its running proxy")
+	}
+	if info, err := os.Stat(webSocket); err != nil || info.Mode()&os.ModeSocket != 0 {
+		t.Errorf("expected web's socket to be left alone, got %v", err)
+	}
+
+	// db's is found by 'orchard docker' and the like.
+	running, err := GetRunningProxy("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running == nil || running.PID != os.Getpid() {
+		t.Fatalf("expected db's proxy to be running in this process, got %+v", running)
+	}
+	if other, err := lockProxy(runDir, "db"); err != nil || other != nil {
+		t.Errorf("expected db's lock to be held, got %v, %v", other, err)
+	}
+
+	proxies.Shutdown()
+	if running, err := GetRunningProxy("db"); err != nil || running != nil {
+		t.Errorf("expected db's proxy to be gone, got %+v, %v", running, err)
+	}
+	for _, name := range []string{"db.sock", "db.pid"} {
+		if _, err := os.Stat(path.Join(runDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/orchardup/go-orchard/utils"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// ExitError is returned by commands whose child process failed, so that
+// orchard exits with the same status without printing an error of its
+// own.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Signals passed on to child processes rather than stopping orchard.
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH}
+
+// Runs a child process until it exits, passing on SIGINT, SIGTERM and
+// SIGWINCH. If it fails, an *ExitError with its exit status is returned,
+// or 128 plus the signal number if it was killed by a signal.
+func RunChild(cmd *exec.Cmd) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// The terminal sends SIGINT and SIGWINCH to the whole foreground
+	// process group, so the child gets those itself. Sending them again
+	// would make a single Ctrl-C look like two.
+	foreground := isForegroundProcessGroup()
+
+	for {
+		select {
+		case sig := <-signals:
+			if foreground && sig != syscall.SIGTERM {
+				continue
+			}
+			cmd.Process.Signal(sig)
+		case err := <-exited:
+			return childExitError(err)
+		}
+	}
+}
+
+func childExitError(err error) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return &ExitError{Code: 1}
+	}
+	if status.Signaled() {
+		return &ExitError{Code: 128 + int(status.Signal())}
+	}
+	return &ExitError{Code: status.ExitStatus()}
+}
+
+// Reports whether this process is in the foreground process group of the
+// terminal on stdin.
+func isForegroundProcessGroup() bool {
+	pgrp, err := utils.ForegroundProcessGroup(os.Stdin)
+	return err == nil && pgrp == syscall.Getpgrp()
+}
@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestRunChildExitStatus(t *testing.T) {
+	tests := []struct {
+		script string
+		code   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + 15},
+		{"kill -KILL $$", 128 + 9},
+	}
+	for _, test := range tests {
+		err := RunChild(exec.Command("sh", "-c", test.script))
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", test.script, err)
+			}
+			continue
+		}
+		exitErr, ok := err.(*ExitError)
+		if !ok || exitErr.Code != test.code {
+			t.Errorf("%s: expected exit status %d, got %#v", test.script, test.code, err)
+		}
+	}
+}
+
+func TestRunChildStartError(t *testing.T) {
+	err := RunChild(exec.Command("/nonexistent/command"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, ok := err.(*ExitError); ok {
+		t.Errorf("expected the error starting the command, got %v", err)
+	}
+}
+
+func TestChildExitError(t *testing.T) {
+	if err := childExitError(nil); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	other := errors.New("wait failed")
+	if err := childExitError(other); err != other {
+		t.Errorf("expected other errors to be returned as they are, got %v", err)
+	}
+	if message := (&ExitError{Code: 3}).Error(); message != "exit status 3" {
+		t.Errorf("unexpected message %q", message)
+	}
+}
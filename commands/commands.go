@@ -1,28 +1,31 @@
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/orchardup/go-orchard/api"
 	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/orchard"
 	"github.com/orchardup/go-orchard/proxy"
 	"github.com/orchardup/go-orchard/tlsconfig"
 	"github.com/orchardup/go-orchard/utils"
 	"github.com/orchardup/go-orchard/vendor/crypto/tls"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path"
 	"strings"
-	"syscall"
 	"text/tabwriter"
+	"time"
 )
 
 type Command struct {
-	Run       func(cmd *Command, args []string) error
+	Run       func(ctx context.Context, cmd *Command, args []string) error
 	UsageLine string
 	Short     string
 	Long      string
@@ -54,45 +57,72 @@ func (c *Command) UsageError(format string, args ...interface{}) error {
 
 var All = []*Command{
 	Docker,
+	Env,
+	Forward,
 	Hosts,
+	Images,
+	Info,
 	IP,
+	Login,
+	Logout,
+	Logs,
+	Profile,
 	Proxy,
+	PS,
 	Run,
+	Stop,
+	Whoami,
 }
 
 var HostSubcommands = []*Command{
+	ListHosts,
 	CreateHost,
 	RemoveHost,
+	InspectHost,
 }
 
 func init() {
 	Hosts.Run = RunHosts
+	ListHosts.Run = RunListHosts
 	CreateHost.Run = RunCreateHost
 	RemoveHost.Run = RunRemoveHost
+	InspectHost.Run = RunInspectHost
 	Docker.Run = RunDocker
+	Env.Run = RunEnv
 	Proxy.Run = RunProxy
 	IP.Run = RunIP
 	Run.Run = RunRun
 }
 
 var Hosts = &Command{
-	UsageLine: "hosts",
+	UsageLine: "hosts [--format FORMAT]",
 	Short:     "Manage hosts",
 	Long: `Manage hosts.
 
-Usage: orchard hosts [COMMAND] [ARGS...]
+Usage: orchard hosts [--format FORMAT] [COMMAND] [ARGS...]
 
 Commands:
   ls          List hosts (default)
   create      Create a host
   rm          Remove a host
+  inspect     Show full details of one or more hosts
 
 Run 'orchard hosts COMMAND -h' for more information on a command.
 `,
 }
 
+var ListHosts = &Command{
+	UsageLine: "ls [--format FORMAT]",
+	Short:     "List hosts",
+	Long: `List hosts.
+
+` + formatUsage,
+}
+
+var flHostsFormat = FormatFlag(Hosts, ListHosts)
+
 var CreateHost = &Command{
-	UsageLine: "create [-m MEMORY] [NAME]",
+	UsageLine: "create [-m MEMORY] [--wait] [--wait-timeout DURATION] [NAME]",
 	Short:     "Create a host",
 	Long: fmt.Sprintf(`Create a host.
 
@@ -100,10 +130,19 @@ You can optionally specify a name for the host - if not, it will be
 named 'default', and 'orchard docker' commands will use it automatically.
 
 You can also specify how much RAM the host should have with -m.
-Valid amounts are %s.`, validSizes),
+Valid amounts are %s.
+
+Set --wait to wait until the host is running and its Docker daemon is
+accepting connections before returning. --wait-timeout sets how long to
+wait (default 5m).
+
+%s`, validSizes, formatUsage),
 }
 
 var flCreateSize = CreateHost.Flag.String("m", "512M", "")
+var flCreateWait = CreateHost.Flag.Bool("wait", false, "")
+var flCreateWaitTimeout = CreateHost.Flag.Duration("wait-timeout", 5*time.Minute, "")
+var flCreateFormat = FormatFlag(CreateHost)
 var validSizes = "512M, 1G, 2G, 4G and 8G"
 
 var RemoveHost = &Command{
@@ -120,6 +159,21 @@ Set -f to bypass the confirmation step, at your peril.
 
 var flRemoveHostForce = RemoveHost.Flag.Bool("f", false, "")
 
+var InspectHost = &Command{
+	UsageLine: "inspect [--show-secrets] [--format FORMAT] NAME [NAME...]",
+	Short:     "Show full details of one or more hosts",
+	Long: `Show full details of one or more hosts, including the client
+certificate used to connect to each host's Docker daemon.
+
+The client certificate's private key is redacted - set --show-secrets to
+include it.
+
+` + formatUsage,
+}
+
+var flInspectShowSecrets = InspectHost.Flag.Bool("show-secrets", false, "")
+var flInspectFormat = FormatFlag(InspectHost)
+
 var Docker = &Command{
 	UsageLine: "docker [-H HOST] [COMMAND...]",
 	Short:     "Run a Docker command against a host",
@@ -130,13 +184,15 @@ Wraps the 'docker' command-line tool - see the Docker website for reference:
     http://docs.docker.io/en/latest/reference/commandline/
 
 You can optionally specify a host by name - if you don't, the default host
-will be used.`,
+will be used.
+
+orchard exits with docker's exit status, as with 'orchard run'.`,
 }
 
 var flDockerHost = Docker.Flag.String("H", "", "")
 
 var Proxy = &Command{
-	UsageLine: "proxy [-H HOST] [LISTEN_URL]",
+	UsageLine: "proxy [-H HOST | --all] [--tls | --token TOKEN] [--log-requests] [--policy FILE] [--idle-timeout DURATION] [LISTEN_URL | COMMAND]",
 	Short:     "Start a local proxy to a host's Docker daemon",
 	Long: `Start a local proxy to a host's Docker daemon.
 
@@ -152,21 +208,112 @@ Instead, you can specify a URL to listen on, which can be a socket or TCP addres
 
     $ orchard proxy unix:///path/to/socket
     $ orchard proxy tcp://localhost:1234
+
+Anyone who can connect to a proxy has root access to the host, so
+proxies refuse to listen on TCP addresses other than loopback ones unless
+clients have to authenticate. Set --tls to require TLS with client
+certificates: a CA and a client certificate are generated in
+~/.orchard/proxy-certs, which Docker uses with DOCKER_TLS_VERIFY=1 and
+DOCKER_CERT_PATH set to that directory. Or set --token (or
+ORCHARD_PROXY_TOKEN) to require an "Authorization: Bearer TOKEN" header
+on each request. Set --insecure to listen without either.
+
+Set --all to proxy to all your hosts from one process, with a socket for
+each host at ~/.orchard/run/HOST.sock. Hosts you create or remove while
+it's running are picked up every --refresh interval (30s by default). If
+you also specify a URL, it's listened on and requests are routed to hosts
+by a /hosts/NAME/ path prefix or an X-Orchard-Host header, going to the
+default host if there's neither:
+
+    $ orchard proxy --all tcp://localhost:2375
+    $ curl -H 'X-Orchard-Host: web' http://localhost:2375/containers/json
+    $ curl http://localhost:2375/hosts/web/containers/json
+
+Hosts that already have a proxy running, from 'orchard proxy start', are
+left to it. The rest are listed by 'orchard proxy ls' and used by
+'orchard docker', and 'orchard proxy stop HOST' stops the whole process.
+
+Set --log-requests to log each Docker Remote API request made through the
+proxy, with its response status and latency. Requests are logged to stderr,
+or to the file given with --log-file. Set --log-bodies to also log (the
+start of) request and response bodies.
+
+Failed connections to the host's Docker daemon are retried a few times,
+and Docker clients get an error response if it's unreachable. The daemon
+is also checked every --health-interval (30s by default; 0 turns checks
+off), and the proxy reports when it goes down or comes back up.
+
+Set --metrics-addr to serve the proxy's metrics over HTTP at that address,
+e.g. localhost:9100. Connection and traffic counters and dial latencies
+are served at /metrics in the Prometheus text format, and along with the
+host's health as JSON at /status.
+
+Set --policy to restrict the requests the proxy will forward, using a
+YAML or JSON policy file, e.g.
+
+    read_only: false
+    deny_privileged: true
+    deny_host_binds: true
+    deny:
+      - method: DELETE
+        path: /containers
+      - path: /containers/*/exec
+
+read_only denies everything but GET and HEAD requests. deny_privileged
+denies containers that are privileged, add capabilities such as SYS_ADMIN,
+use host devices, disable confinement or share the host's PID, IPC,
+network, UTS or user namespace, and privileged exec commands.
+deny_host_binds denies containers and volumes that bind-mount paths from
+the host. These check container, exec and volume creation only: builds,
+plugins and services can also reach the host, so deny them with rules if
+you need to. Each deny rule matches a method (any, if omitted) and a path
+prefix, without the API version. Denied requests get a 403 error.
+
+Set --idle-timeout to stop the proxy once it's had no connections for
+that long. To listen on a socket passed by systemd socket activation
+(LISTEN_FDS), use the URL fd://. 'orchard proxy install-unit' sets this
+up for you.
+
+To keep a proxy running in the background, shared between terminals, use
+these commands:
+
+  start         Start a long-lived proxy to a host
+  ls            List running proxies
+  status        Show whether a proxy's host is reachable
+  stop          Stop a running proxy
+  install-unit  Install systemd units that start a proxy on first use
+
+Run 'orchard proxy COMMAND -h' for more information on a command.
 `,
 }
 
 var flProxyHost = Proxy.Flag.String("H", "", "")
+var flProxyLogRequests = Proxy.Flag.Bool("log-requests", false, "")
+var flProxyLogFile = Proxy.Flag.String("log-file", "", "")
+var flProxyLogBodies = Proxy.Flag.Bool("log-bodies", false, "")
+var flProxyPolicy = Proxy.Flag.String("policy", "", "")
+var flProxyAll = Proxy.Flag.Bool("all", false, "")
+var flProxyRefresh = Proxy.Flag.Duration("refresh", 30*time.Second, "")
+var flProxyHealthInterval = Proxy.Flag.Duration("health-interval", DefaultHealthCheckInterval, "")
+var flProxyMetricsAddr = Proxy.Flag.String("metrics-addr", "", "")
+var flProxyTLS = Proxy.Flag.Bool("tls", false, "")
+var flProxyToken = Proxy.Flag.String("token", os.Getenv("ORCHARD_PROXY_TOKEN"), "")
+var flProxyInsecure = Proxy.Flag.Bool("insecure", false, "")
+var flProxyIdleTimeout = Proxy.Flag.Duration("idle-timeout", 0, "")
 
 var IP = &Command{
-	UsageLine: "ip [NAME]",
+	UsageLine: "ip [--format FORMAT] [NAME]",
 	Short:     "Print a hosts's IP address to stdout",
 	Long: `Print a hosts's IP address to stdout.
 
 You can optionally specify which host - if you don't, the default
 host (named 'default') will be assumed.
-`,
+
+` + formatUsage,
 }
 
+var flIPFormat = FormatFlag(IP)
+
 var Run = &Command{
 	UsageLine: "run [-H HOST] COMMAND [ARGS...]",
 	Short:     "Run a command with the DOCKER_HOST envvar set",
@@ -179,54 +326,77 @@ $ orchard run fig up
 
 You can optionally specify which host - if you don't, the default
 host (named 'default') will be assumed.
+
+orchard exits with the command's exit status, or 128 plus the signal
+number if it was killed by a signal. SIGINT, SIGTERM and SIGWINCH are
+passed on to the command, and the proxy keeps running until it exits.
 `,
 }
 
 var flRunHost = Run.Flag.String("H", "", "")
 
-func RunHosts(cmd *Command, args []string) error {
-	list := len(args) == 0 || (len(args) == 1 && args[0] == "ls")
+func RunHosts(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) == 0 {
+		return RunListHosts(ctx, ListHosts, args)
+	}
 
-	if !list {
-		for _, subcommand := range HostSubcommands {
-			if subcommand.Name() == args[0] {
-				subcommand.Flag.Usage = func() { subcommand.Usage() }
-				subcommand.Flag.Parse(args[1:])
-				args = subcommand.Flag.Args()
-				err := subcommand.Run(subcommand, args)
-				return err
-			}
+	for _, subcommand := range HostSubcommands {
+		if subcommand.Name() == args[0] {
+			subcommand.Flag.Usage = func() { subcommand.Usage() }
+			subcommand.Flag.Parse(args[1:])
+			args = subcommand.Flag.Args()
+			err := subcommand.Run(ctx, subcommand, args)
+			return err
 		}
+	}
+
+	return fmt.Errorf("Unknown `hosts` subcommand: %s", args[0])
+}
+
+func RunListHosts(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard hosts ls` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
 
-		return fmt.Errorf("Unknown `hosts` subcommand: %s", args[0])
+	if err := ValidateFormat(*flHostsFormat); err != nil {
+		return err
 	}
 
-	httpClient, err := authenticator.Authenticate()
+	httpClient, err := authenticator.Authenticate(ctx)
 	if err != nil {
 		return err
 	}
 
-	hosts, err := httpClient.GetHosts()
+	hosts, err := httpClient.GetHostsContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
-	fmt.Fprintln(writer, "NAME\tSIZE\tIP")
+	infos := []*HostInfo{}
 	for _, host := range hosts {
-		fmt.Fprintf(writer, "%s\t%s\t%s\n", host.Name, utils.HumanSize(host.Size*1024*1024), host.IPAddress)
+		infos = append(infos, NewHostInfo(host))
 	}
-	writer.Flush()
 
-	return nil
+	return WriteOutput(os.Stdout, *flHostsFormat, infos, func(w io.Writer) error {
+		writer := tabwriter.NewWriter(w, 20, 1, 3, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tSIZE\tIP")
+		for _, info := range infos {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", info.Name, info.HumanSize(), info.IPAddress)
+		}
+		return writer.Flush()
+	})
 }
 
-func RunCreateHost(cmd *Command, args []string) error {
+func RunCreateHost(ctx context.Context, cmd *Command, args []string) error {
 	if len(args) > 1 {
 		return cmd.UsageError("`orchard hosts create` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
 	}
 
-	httpClient, err := authenticator.Authenticate()
+	if err := ValidateFormat(*flCreateFormat); err != nil {
+		return err
+	}
+
+	httpClient, err := authenticator.Authenticate(ctx)
 	if err != nil {
 		return err
 	}
@@ -240,30 +410,46 @@ func RunCreateHost(cmd *Command, args []string) error {
 		return nil
 	}
 
-	host, err := httpClient.CreateHost(hostName, size)
+	host, err := httpClient.CreateHostContext(ctx, hostName, size)
 	if err != nil {
-		// HACK. api.go should decode JSON and return a specific type of error for this case.
-		if strings.Contains(err.Error(), "already exists") {
+		if api.IsConflict(err) {
 			fmt.Fprintf(os.Stderr, "%s is already running.\nYou can create additional hosts with `orchard hosts create [NAME]`.\n", humanName)
 			return nil
 		}
-		if strings.Contains(err.Error(), "Invalid value") {
+		if api.IsInvalidField(err, "name") {
 			fmt.Fprintf(os.Stderr, "Sorry, '%s' isn't a valid host name.\nHost names can only contain lowercase letters, numbers and underscores.\n", hostName)
 			return nil
 		}
-		if strings.Contains(err.Error(), "Unsupported size") {
+		if api.IsInvalidField(err, "size") {
 			fmt.Fprintf(os.Stderr, "Sorry, %q isn't a size we support.\nValid sizes are %s.\n", sizeString, validSizes)
 			return nil
 		}
 
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "%s running at %s\n", humanName, host.IPAddress)
 
-	return nil
+	if *flCreateWait {
+		fmt.Fprintf(os.Stderr, "Waiting for %s to start...\n", humanName)
+
+		waitCtx, cancel := context.WithTimeout(ctx, *flCreateWaitTimeout)
+		defer cancel()
+
+		host, err = WaitForHost(waitCtx, httpClient, hostName)
+		if waitCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Timed out after %s waiting for %s to start.", *flCreateWaitTimeout, humanName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return WriteOutput(os.Stdout, *flCreateFormat, NewHostInfo(host), func(w io.Writer) error {
+		fmt.Fprintf(os.Stderr, "%s running at %s\n", humanName, host.IPAddress)
+		return nil
+	})
 }
 
-func RunRemoveHost(cmd *Command, args []string) error {
+func RunRemoveHost(ctx context.Context, cmd *Command, args []string) error {
 	if len(args) > 1 {
 		return cmd.UsageError("`orchard hosts rm` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
 	}
@@ -271,25 +457,26 @@ func RunRemoveHost(cmd *Command, args []string) error {
 	hostName, humanName := GetHostName(args)
 
 	if !*flRemoveHostForce {
-		var confirm string
 		fmt.Printf("Going to remove %s. All data on it will be lost.\n", humanName)
 		fmt.Print("Are you sure you're ready? [yN] ")
-		fmt.Scanln(&confirm)
+		confirm, err := utils.ReadLine(ctx)
+		if err != nil {
+			return err
+		}
 
 		if strings.ToLower(confirm) != "y" {
 			return nil
 		}
 	}
 
-	httpClient, err := authenticator.Authenticate()
+	httpClient, err := authenticator.Authenticate(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = httpClient.DeleteHost(hostName)
+	err = httpClient.DeleteHostContext(ctx, hostName)
 	if err != nil {
-		// HACK. api.go should decode JSON and return a specific type of error for this case.
-		if strings.Contains(err.Error(), "Not found") {
+		if api.IsNotFound(err) {
 			fmt.Fprintf(os.Stderr, "%s doesn't seem to be running.\nYou can view your running hosts with `orchard hosts`.\n", utils.Capitalize(humanName))
 			return nil
 		}
@@ -301,17 +488,75 @@ func RunRemoveHost(cmd *Command, args []string) error {
 	return nil
 }
 
-func RunDocker(cmd *Command, args []string) error {
-	return WithDockerProxy("", *flDockerHost, func(listenURL string) error {
-		err := CallDocker(args, listenURL)
+func RunInspectHost(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) < 1 {
+		return cmd.UsageError("`orchard hosts inspect` expects at least 1 argument")
+	}
+
+	if err := ValidateFormat(*flInspectFormat); err != nil {
+		return err
+	}
+
+	httpClient, err := authenticator.Authenticate(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		details []*HostDetails
+		failed  bool
+	)
+	for _, hostName := range args {
+		host, err := GetHostWithClient(ctx, httpClient, hostName)
 		if err != nil {
-			return fmt.Errorf("Docker exited with error")
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
 		}
-		return nil
+		details = append(details, NewHostDetails(host, *flInspectShowSecrets))
+	}
+
+	if len(details) > 0 {
+		err = WriteOutput(os.Stdout, *flInspectFormat, details, func(w io.Writer) error {
+			for i, d := range details {
+				if i > 0 {
+					fmt.Fprintln(w)
+				}
+				if err := d.WriteTable(w); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed {
+		return errors.New("Some hosts could not be inspected.")
+	}
+	return nil
+}
+
+func RunDocker(ctx context.Context, cmd *Command, args []string) error {
+	return WithSharedDockerProxy(ctx, *flDockerHost, func(ctx context.Context, listenURL string) error {
+		return CallDocker(args, listenURL)
 	})
 }
 
-func RunProxy(cmd *Command, args []string) error {
+func RunProxy(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		for _, subcommand := range ProxySubcommands {
+			if subcommand.Name() == args[0] {
+				subcommand.Flag.Usage = func() { subcommand.Usage() }
+				subcommand.Flag.Parse(args[1:])
+				args = subcommand.Flag.Args()
+				return subcommand.Run(ctx, subcommand, args)
+			}
+		}
+	}
+
 	specifiedURL := ""
 
 	if len(args) == 1 {
@@ -320,54 +565,231 @@ func RunProxy(cmd *Command, args []string) error {
 		return cmd.UsageError("`orchard proxy` expects at most 1 argument, but got: %s", strings.Join(args, " "))
 	}
 
-	return WithDockerProxy(specifiedURL, *flProxyHost, func(listenURL string) error {
-		fmt.Fprintf(os.Stderr, `Started proxy. Use it by setting your Docker host:
-export DOCKER_HOST=%s
-`, listenURL)
+	opts := &ProxyOptions{
+		LogRequests: *flProxyLogRequests || *flProxyLogFile != "" || *flProxyLogBodies,
+		LogFile:     *flProxyLogFile,
+		LogBodies:   *flProxyLogBodies,
+		Policy:      *flProxyPolicy,
+
+		HealthCheckInterval: *flProxyHealthInterval,
+		MetricsAddr:         *flProxyMetricsAddr,
+
+		TLS:       *flProxyTLS,
+		AuthToken: *flProxyToken,
+		Insecure:  *flProxyInsecure,
+
+		IdleTimeout: *flProxyIdleTimeout,
+	}
+
+	if *flProxyIdleTimeout < 0 {
+		return cmd.UsageError("--idle-timeout can't be negative, but got %s", *flProxyIdleTimeout)
+	}
+
+	if err := CheckListenerSecurity(specifiedURL, opts); err != nil {
+		return err
+	}
+
+	if *flProxyAll {
+		if *flProxyHost != "" {
+			return cmd.UsageError("`orchard proxy --all` can't be used with -H")
+		}
+		if *flProxyIdleTimeout > 0 {
+			return cmd.UsageError("`orchard proxy --all` can't be used with --idle-timeout")
+		}
+		if *flProxyRefresh <= 0 {
+			return cmd.UsageError("--refresh must be positive, but got %s", *flProxyRefresh)
+		}
+		return RunAllProxies(ctx, specifiedURL, opts, *flProxyRefresh)
+	}
+
+	return WithDockerProxy(ctx, specifiedURL, *flProxyHost, opts, func(ctx context.Context, listenURL string) error {
+		if strings.HasPrefix(listenURL, "fd://") {
+			fmt.Fprintln(os.Stderr, "Started proxy on the socket passed by socket activation")
+		} else {
+			PrintProxyUsage(listenURL, opts)
+		}
 
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGKILL)
-		<-c
+		<-ctx.Done()
 
 		fmt.Fprintln(os.Stderr, "\nStopping proxy")
 		return nil
 	})
 }
 
-func RunIP(cmd *Command, args []string) error {
+func RunIP(ctx context.Context, cmd *Command, args []string) error {
 	if len(args) > 1 {
 		return cmd.UsageError("`orchard ip` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
 	}
 
+	if err := ValidateFormat(*flIPFormat); err != nil {
+		return err
+	}
+
 	hostName, _ := GetHostName(args)
 
-	host, err := GetHost(hostName)
+	host, err := GetHost(ctx, hostName)
 	if err != nil {
 		return err
 	}
 
-	fmt.Fprintln(os.Stdout, host.IPAddress)
-	return nil
+	return WriteOutput(os.Stdout, *flIPFormat, NewHostInfo(host), func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, host.IPAddress)
+		return err
+	})
 }
 
-func RunRun(cmd *Command, args []string) error {
+func RunRun(ctx context.Context, cmd *Command, args []string) error {
 	if len(args) < 1 {
 		return cmd.UsageError("`orchard run` expects at least 1 argument")
 	}
-	return WithDockerProxy("", *flRunHost, func(listenURL string) error {
+	return WithSharedDockerProxy(ctx, *flRunHost, func(ctx context.Context, listenURL string) error {
 		os.Setenv("DOCKER_HOST", listenURL)
 
 		cmd := exec.Command(args[0], args[1:]...)
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		return cmd.Run()
+		return RunChild(cmd)
 	})
 }
 
-func WithDockerProxy(listenURL, hostName string, callback func(string) error) error {
+// ProxyOptions configures the proxies started by WithDockerProxy.
+type ProxyOptions struct {
+	LogRequests bool
+	LogFile     string
+	LogBodies   bool
+
+	// Policy is the path to a policy file restricting the requests the
+	// proxy will forward.
+	Policy string
+
+	// If HealthCheckInterval is set, the host's Docker daemon is checked
+	// that often and changes in its health are reported on stderr and, if
+	// StatusFile is set, written there as JSON.
+	HealthCheckInterval time.Duration
+	StatusFile          string
+
+	// If MetricsAddr is set, the proxy's metrics are served there over
+	// HTTP, in the Prometheus text format at /metrics and as JSON at
+	// /status.
+	MetricsAddr string
+
+	// TLS makes the proxy's listener require a client certificate signed
+	// by the proxy CA, and AuthToken makes it require a bearer token.
+	// Unless Insecure is set, proxies refuse to listen on non-loopback
+	// TCP addresses without one of them.
+	TLS       bool
+	AuthToken string
+	Insecure  bool
+
+	// If IdleTimeout is set, the proxy exits once it's had no connections
+	// for that long.
+	IdleTimeout time.Duration
+}
+
+// Applies the options to a host's proxy. The returned function releases
+// any resources, such as the log file, once the proxy has stopped.
+func (opts *ProxyOptions) Apply(p *proxy.Proxy, hostName string) (func(), error) {
+	closer := func() {}
+	if opts == nil {
+		return closer, nil
+	}
+
+	if err := opts.secureListener(p); err != nil {
+		return nil, err
+	}
+	p.AuthToken = opts.AuthToken
+	p.IdleTimeout = opts.IdleTimeout
+
+	if opts.Policy != "" {
+		policy, err := proxy.LoadPolicy(opts.Policy)
+		if err != nil {
+			return nil, err
+		}
+		p.Policy = policy
+	}
+
+	if opts.LogRequests {
+		var logOutput io.Writer = os.Stderr
+		if opts.LogFile != "" {
+			logFile, err := os.OpenFile(opts.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return nil, err
+			}
+			logOutput = logFile
+			closer = func() { logFile.Close() }
+		}
+		p.Logger = proxy.NewRequestLogger(logOutput, opts.LogBodies)
+	}
+
+	if opts.HealthCheckInterval > 0 {
+		p.HealthCheckInterval = opts.HealthCheckInterval
+		p.OnHealthChange = func(status proxy.HealthStatus) {
+			ReportHealth("", status)
+			if opts.StatusFile != "" {
+				if err := WriteHealthStatus(opts.StatusFile, status); err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing status: %s\n", err)
+				}
+			}
+		}
+		if opts.StatusFile != "" {
+			closeLog := closer
+			closer = func() {
+				closeLog()
+				os.Remove(opts.StatusFile)
+			}
+		}
+	}
+
+	if opts.MetricsAddr != "" {
+		stopMetrics, err := ServeMetrics(opts.MetricsAddr, func() map[string]*proxy.Proxy {
+			return map[string]*proxy.Proxy{hostName: p}
+		})
+		if err != nil {
+			closer()
+			return nil, err
+		}
+		closeRest := closer
+		closer = func() {
+			stopMetrics()
+			closeRest()
+		}
+	}
+
+	return closer, nil
+}
+
+// Serves the metrics of the proxies returned by proxies on addr, until
+// the returned function is called.
+func ServeMetrics(addr string, proxies func() map[string]*proxy.Proxy) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error serving metrics: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Serving metrics at http://%s/metrics and status at http://%s/status\n", listener.Addr(), listener.Addr())
+
+	server := &http.Server{Handler: proxy.MetricsHandler(proxies)}
+	go server.Serve(listener)
+	return func() { server.Close() }, nil
+}
+
+// Prints a change in a host's health to stderr.
+func ReportHealth(hostName string, status proxy.HealthStatus) {
+	daemon := "Docker daemon"
+	if hostName != "" {
+		daemon = fmt.Sprintf("Docker daemon on %s", GetHumanHostName(hostName))
+	}
+	switch status.State {
+	case proxy.HealthUp:
+		fmt.Fprintf(os.Stderr, "%s is up\n", daemon)
+	case proxy.HealthDown:
+		fmt.Fprintf(os.Stderr, "%s is unreachable: %s\n", daemon, status.Error)
+	}
+}
+
+func WithDockerProxy(ctx context.Context, listenURL, hostName string, opts *ProxyOptions, callback func(ctx context.Context, listenURL string) error) error {
 	if hostName == "" {
-		hostName = "default"
+		hostName = authenticator.DefaultHostName()
 	}
 
 	if listenURL == "" {
@@ -384,26 +806,58 @@ func WithDockerProxy(listenURL, hostName string, callback func(string) error) er
 		return err
 	}
 
-	p, err := MakeProxy(listenType, listenAddr, hostName)
+	p, err := MakeProxy(ctx, listenType, listenAddr, hostName)
 	if err != nil {
 		return fmt.Errorf("Error starting proxy: %v\n", err)
 	}
 
-	go p.Start()
-	defer p.Stop()
+	closeOptions, err := opts.Apply(p, hostName)
+	if err != nil {
+		return fmt.Errorf("Error starting proxy: %v\n", err)
+	}
+	defer closeOptions()
 
-	if err := <-p.ErrorChannel; err != nil {
+	if err := p.Listen(); err != nil {
 		return fmt.Errorf("Error starting proxy: %v\n", err)
 	}
 
-	if err := callback(listenURL); err != nil {
-		return err
+	// The proxy keeps serving until the callback returns, even if ctx is
+	// canceled, so that commands using it can finish cleanly. The
+	// callback's context is canceled if the proxy stops serving early.
+	proxyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- p.Serve(context.Background())
+		cancel()
+	}()
+
+	callbackErr := callback(proxyCtx, listenURL)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), ProxyShutdownTimeout)
+	defer cancelShutdown()
+	if err, ok := p.Shutdown(shutdownCtx).(*proxy.ShutdownError); ok {
+		fmt.Fprintf(os.Stderr, "Closed %d connections that were still active after %s\n", err.Closed, ProxyShutdownTimeout)
 	}
 
-	return nil
+	if err := <-served; err == proxy.ErrProxyIdle {
+		fmt.Fprintf(os.Stderr, "Stopped proxy after %s without connections\n", p.IdleTimeout)
+	} else if err != nil && err != proxy.ErrProxyClosed {
+		return fmt.Errorf("Proxy stopped with error: %v", err)
+	}
+
+	return callbackErr
 }
 
-var validListenTypes = []string{"tcp", "tcp4", "tcp6", "unix", "unixpacket"}
+// How often long-running proxies check their host's Docker daemon.
+var DefaultHealthCheckInterval = 30 * time.Second
+
+// How long to wait for connections to finish when a proxy is stopped.
+var ProxyShutdownTimeout = 10 * time.Second
+
+// fd:// listens on the socket passed by systemd socket activation.
+var validListenTypes = []string{"tcp", "tcp4", "tcp6", "unix", "unixpacket", "fd"}
 
 func ListenArgs(url string) (string, string, error) {
 	parts := strings.SplitN(url, "://", 2)
@@ -418,31 +872,86 @@ func ListenArgs(url string) (string, string, error) {
 	return "", "", fmt.Errorf("Invalid URL type: %q", parts[0])
 }
 
-func MakeProxy(listenType, listenAddr string, hostName string) (*proxy.Proxy, error) {
-	host, err := GetHost(hostName)
+func MakeProxy(ctx context.Context, listenType, listenAddr string, hostName string) (*proxy.Proxy, error) {
+	host, err := GetHost(ctx, hostName)
 	if err != nil {
 		return nil, err
 	}
 
-	destination := host.IPAddress + ":4243"
+	dialFunc, err := DockerDialFunc(host)
+	if err != nil {
+		return nil, err
+	}
 
-	certData := []byte(host.ClientCert)
-	keyData := []byte(host.ClientKey)
-	config, err := tlsconfig.GetTLSConfig(certData, keyData)
+	return proxy.New(ListenFunc(listenType, listenAddr), dialFunc), nil
+}
+
+// Returns a function that listens on the given address, or on the socket
+// passed by socket activation if listenType is "fd".
+func ListenFunc(listenType, listenAddr string) func() (net.Listener, error) {
+	if listenType == "fd" {
+		return proxy.ActivationListener
+	}
+	return func() (net.Listener, error) { return net.Listen(listenType, listenAddr) }
+}
+
+// Returns a function that connects to a host's Docker daemon over TLS,
+// authenticating with the host's client certificate.
+func DockerDialFunc(host *api.Host) (func() (net.Conn, error), error) {
+	// Checks the host's certificates up front.
+	if _, err := tlsconfig.GetTLSConfig([]byte(host.ClientCert), []byte(host.ClientKey), authenticator.HostCAFile()); err != nil {
+		return nil, err
+	}
+
+	return func() (net.Conn, error) { return orchard.DialHost(context.Background(), host) }, nil
+}
+
+func WaitForHost(ctx context.Context, httpClient *api.HTTPClient, hostName string) (*api.Host, error) {
+	host, err := httpClient.WaitForHost(ctx, hostName, api.HostRunning)
 	if err != nil {
 		return nil, err
 	}
 
-	return proxy.New(
-		func() (net.Listener, error) { return net.Listen(listenType, listenAddr) },
-		func() (net.Conn, error) { return tls.Dial("tcp", destination, config) },
-	), nil
+	config, err := tlsconfig.GetTLSConfig([]byte(host.ClientCert), []byte(host.ClientKey), authenticator.HostCAFile())
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := ProbeDocker(host, config); err == nil {
+			return host, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(api.HostPollInterval):
+		}
+	}
+}
+
+// Checks that a TLS handshake with the host's Docker daemon succeeds.
+func ProbeDocker(host *api.Host, config *tls.Config) error {
+	conn, err := net.DialTimeout("tcp", DockerAddress(host), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	config.ServerName = host.IPAddress
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	return tlsConn.Handshake()
+}
+
+func DockerAddress(host *api.Host) string {
+	return orchard.DockerAddress(host)
 }
 
 func CallDocker(args []string, dockerHost string) error {
 	dockerPath := GetDockerPath()
 	if dockerPath == "" {
-		return errors.New("Can't find `docker` executable in $PATH.\nYou might need to install it: http://docs.docker.io/en/latest/installation/#installation-list")
+		return errors.New("Can't find `docker` executable in $PATH.\nYou might need to install it: http://docs.docker.io/en/latest/installation/#installation-list\n'orchard ps', 'images', 'logs', 'stop' and 'info' work without it.")
 	}
 
 	os.Setenv("DOCKER_HOST", dockerHost)
@@ -451,7 +960,7 @@ func CallDocker(args []string, dockerHost string) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return RunChild(cmd)
 }
 
 func GetDockerPath() string {
@@ -466,7 +975,7 @@ func GetDockerPath() string {
 }
 
 func GetHostName(args []string) (string, string) {
-	hostName := "default"
+	hostName := authenticator.DefaultHostName()
 
 	if len(args) > 0 {
 		hostName = args[0]
@@ -499,16 +1008,19 @@ func GetHostSize() (int, string) {
 	return int(megs), sizeString
 }
 
-func GetHost(hostName string) (*api.Host, error) {
-	httpClient, err := authenticator.Authenticate()
+func GetHost(ctx context.Context, hostName string) (*api.Host, error) {
+	httpClient, err := authenticator.Authenticate(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	host, err := httpClient.GetHost(hostName)
+	return GetHostWithClient(ctx, httpClient, hostName)
+}
+
+func GetHostWithClient(ctx context.Context, httpClient *api.HTTPClient, hostName string) (*api.Host, error) {
+	host, err := httpClient.GetHostContext(ctx, hostName)
 	if err != nil {
-		// HACK. api.go should decode JSON and return a specific type of error for this case.
-		if strings.Contains(err.Error(), "Not found") {
+		if api.IsNotFound(err) {
 			humanName := GetHumanHostName(hostName)
 			return nil, fmt.Errorf("%s doesn't seem to be running.\nYou can create it with `orchard hosts create %s`.", utils.Capitalize(humanName), hostName)
 		}
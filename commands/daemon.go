@@ -0,0 +1,557 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/proxy"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var ProxySubcommands = []*Command{
+	StartProxy,
+	ListProxies,
+	StatusProxy,
+	StopProxy,
+	InstallUnit,
+}
+
+var StartProxy = &Command{
+	UsageLine: "start [-H HOST] [-d] [--metrics-addr ADDR]",
+	Short:     "Start a long-lived proxy to a host",
+	Long: `Start a long-lived proxy to a host's Docker daemon, listening on a
+Unix socket at a stable path:
+
+    $ orchard proxy start -d
+    Started proxy for default host at unix:///home/you/.orchard/run/default.sock
+
+There's at most one such proxy per host, which can be shared by any number
+of terminals and editors. 'orchard docker' and 'orchard run' use it
+automatically if it's running.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+
+Set -d to run the proxy in the background. Its output is written to
+~/.orchard/run/HOST.log.
+
+Set --metrics-addr to serve the proxy's metrics and status over HTTP at
+that address, as with 'orchard proxy'.
+`,
+}
+
+var flStartProxyHost = StartProxy.Flag.String("H", "", "")
+var flStartProxyDetach = StartProxy.Flag.Bool("d", false, "")
+var flStartProxyMetricsAddr = StartProxy.Flag.String("metrics-addr", "", "")
+
+var ListProxies = &Command{
+	UsageLine: "ls [--format FORMAT]",
+	Short:     "List running proxies",
+	Long: `List proxies started with 'orchard proxy start'.
+
+` + formatUsage,
+}
+
+var flListProxiesFormat = FormatFlag(ListProxies)
+
+var StatusProxy = &Command{
+	UsageLine: "status [--format FORMAT] [HOST]",
+	Short:     "Show whether a proxy's host is reachable",
+	Long: `Show whether the Docker daemon behind a proxy started with 'orchard proxy
+start' is reachable, as of the proxy's last health check. Exits with an
+error if it isn't, or if no proxy is running.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+
+` + formatUsage,
+}
+
+var flStatusProxyFormat = FormatFlag(StatusProxy)
+
+var StopProxy = &Command{
+	UsageLine: "stop [HOST...]",
+	Short:     "Stop a running proxy",
+	Long: `Stop proxies started with 'orchard proxy start'.
+
+You can optionally specify which hosts' proxies to stop - if you don't, the
+default host's proxy will be stopped.
+`,
+}
+
+func init() {
+	StartProxy.Run = RunStartProxy
+	ListProxies.Run = RunListProxies
+	StatusProxy.Run = RunStatusProxy
+	StopProxy.Run = RunStopProxy
+}
+
+// ProxyInfo describes a proxy started with 'orchard proxy start'.
+type ProxyInfo struct {
+	Host    string              `json:"host"`
+	PID     int                 `json:"pid"`
+	URL     string              `json:"url"`
+	LogFile string              `json:"log_file"`
+	Health  *proxy.HealthStatus `json:"health"`
+}
+
+func GetRunDir() (string, error) {
+	return GetProfileDir("run")
+}
+
+// Returns the proxy running for a host, or nil if there isn't one. Stale
+// pidfiles left behind by proxies that died are removed.
+//
+// A proxy holds an exclusive lock on its lock file for as long as it
+// runs, so that's what says whether it's running rather than its pidfile,
+// whose PID may belong to another process by now.
+func GetRunningProxy(hostName string) (*ProxyInfo, error) {
+	runDir, err := GetRunDir()
+	if err != nil {
+		return nil, err
+	}
+	pidFile := path.Join(runDir, hostName+".pid")
+
+	lock, err := os.Open(path.Join(runDir, hostName+".lock"))
+	if os.IsNotExist(err) {
+		os.Remove(pidFile)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	// Holding a shared lock keeps a new proxy from starting while the
+	// stale pidfile is removed.
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		os.Remove(pidFile)
+		return nil, nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return nil, err
+	}
+
+	// The pidfile is missing while a proxy is still starting.
+	data, err := ioutil.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, nil
+	}
+
+	return &ProxyInfo{
+		Host:    hostName,
+		PID:     pid,
+		URL:     "unix://" + path.Join(runDir, hostName+".sock"),
+		LogFile: path.Join(runDir, hostName+".log"),
+		Health:  ReadHealthStatus(path.Join(runDir, hostName+".status")),
+	}, nil
+}
+
+// Takes the exclusive lock a proxy for the host holds while it runs,
+// returning the locked file, which must be kept open. Returns nil if
+// another proxy holds it.
+func lockProxy(runDir, hostName string) (*os.File, error) {
+	lock, err := os.OpenFile(path.Join(runDir, hostName+".lock"), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		lock.Close()
+		return nil, nil
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Reports whether a proxy for the host holds its lock.
+func isProxyLocked(runDir, hostName string) (bool, error) {
+	lock, err := os.Open(path.Join(runDir, hostName+".lock"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true, nil
+	}
+	return false, err
+}
+
+// Writes a proxy's health to its status file, replacing it atomically so
+// that readers never see it half-written.
+func WriteHealthStatus(filename string, status proxy.HealthStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+// Reads a proxy's health from its status file. It's unknown if the
+// proxy hasn't written one yet.
+func ReadHealthStatus(filename string) *proxy.HealthStatus {
+	status := &proxy.HealthStatus{State: proxy.HealthUnknown}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return status
+	}
+	if err := json.Unmarshal(data, status); err != nil {
+		return &proxy.HealthStatus{State: proxy.HealthUnknown}
+	}
+	return status
+}
+
+// Like WithDockerProxy, but uses the host's long-lived proxy if one is
+// running instead of starting a new one.
+func WithSharedDockerProxy(ctx context.Context, hostName string, callback func(ctx context.Context, listenURL string) error) error {
+	if hostName == "" {
+		hostName = authenticator.DefaultHostName()
+	}
+
+	running, err := GetRunningProxy(hostName)
+	if err != nil {
+		return err
+	}
+	if running != nil {
+		return callback(ctx, running.URL)
+	}
+
+	return WithDockerProxy(ctx, "", hostName, nil, callback)
+}
+
+func RunStartProxy(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard proxy start` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+
+	hostName := *flStartProxyHost
+	if hostName == "" {
+		hostName = authenticator.DefaultHostName()
+	}
+	humanName := GetHumanHostName(hostName)
+
+	running, err := GetRunningProxy(hostName)
+	if err != nil {
+		return err
+	}
+	if running != nil {
+		fmt.Fprintf(os.Stderr, "Proxy for %s is already running at %s\n", humanName, running.URL)
+		return nil
+	}
+
+	if *flStartProxyDetach {
+		return startDetachedProxy(ctx, hostName)
+	}
+
+	runDir, err := GetRunDir()
+	if err != nil {
+		return err
+	}
+	socketPath := path.Join(runDir, hostName+".sock")
+	pidFile := path.Join(runDir, hostName+".pid")
+	statusFile := path.Join(runDir, hostName+".status")
+
+	// Until the lock is held, the socket may be another proxy's that's
+	// starting at the same time.
+	lock, err := lockProxy(runDir, hostName)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		fmt.Fprintf(os.Stderr, "Proxy for %s is already running\n", humanName)
+		return nil
+	}
+	defer lock.Close()
+
+	// Left behind by a proxy that didn't exit cleanly.
+	os.Remove(socketPath)
+	os.Remove(statusFile)
+
+	opts := &ProxyOptions{
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		StatusFile:          statusFile,
+		MetricsAddr:         *flStartProxyMetricsAddr,
+	}
+
+	return WithDockerProxy(ctx, "unix://"+socketPath, hostName, opts, func(ctx context.Context, listenURL string) error {
+		if err := writePidFile(pidFile); err != nil {
+			return err
+		}
+		defer os.Remove(pidFile)
+
+		fmt.Fprintf(os.Stderr, "Started proxy for %s at %s\n", humanName, listenURL)
+
+		<-ctx.Done()
+
+		fmt.Fprintln(os.Stderr, "Stopping proxy")
+		return nil
+	})
+}
+
+// Writes this process's PID to a pidfile, replacing it atomically so that
+// readers never see it half-written.
+func writePidFile(pidFile string) error {
+	tmpFile := pidFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, pidFile)
+}
+
+// Runs 'orchard proxy start' in a new session with output going to the
+// log file, and waits for it to start listening, which it signals by
+// writing its pidfile.
+func startDetachedProxy(ctx context.Context, hostName string) error {
+	// Fetching the host first means any prompting for credentials
+	// happens here rather than in the background, and errors are shown.
+	if _, err := GetHost(ctx, hostName); err != nil {
+		return err
+	}
+
+	runDir, err := GetRunDir()
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	logFile, err := os.OpenFile(path.Join(runDir, hostName+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	childArgs := append(ProfileArgs(), "proxy", "start", "-H", hostName)
+	if *flStartProxyMetricsAddr != "" {
+		childArgs = append(childArgs, "--metrics-addr", *flStartProxyMetricsAddr)
+	}
+	env, err := authenticator.BackgroundEnv(authenticator.GetAPIURL())
+	if err != nil {
+		return err
+	}
+	child := exec.Command(executable, childArgs...)
+	child.Env = append(os.Environ(), env...)
+	child.Stdout = logFile
+	child.Stderr = logFile
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := child.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- child.Wait() }()
+
+	timeout := time.After(30 * time.Second)
+	for {
+		running, err := GetRunningProxy(hostName)
+		if err != nil {
+			return err
+		}
+		if running != nil && running.PID == child.Process.Pid {
+			fmt.Fprintf(os.Stderr, "Started proxy for %s at %s\n", GetHumanHostName(hostName), running.URL)
+			fmt.Println(running.URL)
+			return nil
+		}
+
+		select {
+		case <-exited:
+			return fmt.Errorf("Proxy for %s exited while starting. See %s for details.", GetHumanHostName(hostName), logFile.Name())
+		case <-timeout:
+			child.Process.Kill()
+			return fmt.Errorf("Timed out starting proxy for %s. See %s for details.", GetHumanHostName(hostName), logFile.Name())
+		case <-ctx.Done():
+			child.Process.Kill()
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func RunListProxies(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard proxy ls` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+
+	if err := ValidateFormat(*flListProxiesFormat); err != nil {
+		return err
+	}
+
+	runDir, err := GetRunDir()
+	if err != nil {
+		return err
+	}
+
+	pidFiles, err := ioutil.ReadDir(runDir)
+	if err != nil {
+		return err
+	}
+
+	var hostNames []string
+	for _, fileInfo := range pidFiles {
+		if strings.HasSuffix(fileInfo.Name(), ".pid") {
+			hostNames = append(hostNames, strings.TrimSuffix(fileInfo.Name(), ".pid"))
+		}
+	}
+	sort.Strings(hostNames)
+
+	proxies := []*ProxyInfo{}
+	for _, hostName := range hostNames {
+		running, err := GetRunningProxy(hostName)
+		if err != nil {
+			return err
+		}
+		if running != nil {
+			proxies = append(proxies, running)
+		}
+	}
+
+	return WriteOutput(os.Stdout, *flListProxiesFormat, proxies, func(w io.Writer) error {
+		writer := tabwriter.NewWriter(w, 20, 1, 3, ' ', 0)
+		fmt.Fprintln(writer, "HOST\tPID\tSTATUS\tURL")
+		for _, p := range proxies {
+			fmt.Fprintf(writer, "%s\t%d\t%s\t%s\n", p.Host, p.PID, p.Health.State, p.URL)
+		}
+		return writer.Flush()
+	})
+}
+
+func RunStatusProxy(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 1 {
+		return cmd.UsageError("`orchard proxy status` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+	}
+
+	if err := ValidateFormat(*flStatusProxyFormat); err != nil {
+		return err
+	}
+
+	hostName, humanName := GetHostName(args)
+
+	running, err := GetRunningProxy(hostName)
+	if err != nil {
+		return err
+	}
+	if running == nil {
+		return fmt.Errorf("No proxy is running for %s.", humanName)
+	}
+
+	err = WriteOutput(os.Stdout, *flStatusProxyFormat, running, func(w io.Writer) error {
+		writer := tabwriter.NewWriter(w, 0, 1, 3, ' ', 0)
+		fmt.Fprintf(writer, "Host:\t%s\n", running.Host)
+		fmt.Fprintf(writer, "URL:\t%s\n", running.URL)
+		fmt.Fprintf(writer, "PID:\t%d\n", running.PID)
+		status := running.Health.State
+		if !running.Health.Since.IsZero() {
+			status += " since " + running.Health.Since.Local().Format(time.RFC1123)
+		}
+		fmt.Fprintf(writer, "Status:\t%s\n", status)
+		if running.Health.Error != "" {
+			fmt.Fprintf(writer, "Error:\t%s\n", running.Health.Error)
+		}
+		return writer.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	if running.Health.State == proxy.HealthDown {
+		return fmt.Errorf("The Docker daemon on %s is unreachable.", humanName)
+	}
+	return nil
+}
+
+func RunStopProxy(ctx context.Context, cmd *Command, args []string) error {
+	hostNames := args
+	if len(hostNames) == 0 {
+		hostNames = []string{authenticator.DefaultHostName()}
+	}
+
+	for _, hostName := range hostNames {
+		humanName := GetHumanHostName(hostName)
+
+		running, err := GetRunningProxy(hostName)
+		if err != nil {
+			return err
+		}
+		if running == nil {
+			fmt.Fprintf(os.Stderr, "No proxy is running for %s.\n", humanName)
+			continue
+		}
+
+		runDir, err := GetRunDir()
+		if err != nil {
+			return err
+		}
+		stopped := func() bool {
+			locked, err := isProxyLocked(runDir, hostName)
+			return err == nil && !locked
+		}
+		if err := stopProcess(ctx, running.PID, stopped); err != nil {
+			return fmt.Errorf("Error stopping proxy for %s: %s", humanName, err)
+		}
+		fmt.Fprintf(os.Stderr, "Stopped proxy for %s\n", humanName)
+	}
+
+	return nil
+}
+
+// How long a stopped proxy gets to clean up after waiting
+// ProxyShutdownTimeout for its connections, before it's killed.
+var proxyCleanupTimeout = 5 * time.Second
+
+// Sends SIGTERM to a process and waits until stopped reports that it's
+// exited, resorting to SIGKILL if it takes longer than a proxy is allowed
+// to: ProxyShutdownTimeout to drain its connections, and then
+// proxyCleanupTimeout to remove its socket, pidfile and status file.
+func stopProcess(ctx context.Context, pid int, stopped func() bool) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(ProxyShutdownTimeout + proxyCleanupTimeout)
+	for !stopped() {
+		if time.Now().After(deadline) {
+			return syscall.Kill(pid, syscall.SIGKILL)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Sets HOME to a new directory for the test, returning its run dir and a
+// function that restores HOME and removes the directory.
+func withTempHome(t *testing.T) (string, func()) {
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHome, oldProfile := os.Getenv("HOME"), os.Getenv("ORCHARD_PROFILE")
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_PROFILE", "")
+
+	runDir, err := GetRunDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runDir, func() {
+		os.Setenv("HOME", oldHome)
+		os.Setenv("ORCHARD_PROFILE", oldProfile)
+		os.RemoveAll(home)
+	}
+}
+
+func TestStalePidFileIsRemoved(t *testing.T) {
+	runDir, cleanup := withTempHome(t)
+	defer cleanup()
+
+	// The PID has been reused by a live process, this one, but nothing
+	// holds the lock, so the proxy that wrote it is gone.
+	pidFile := path.Join(runDir, "web.pid")
+	for _, lockExists := range []bool{false, true} {
+		if lockExists {
+			if err := ioutil.WriteFile(path.Join(runDir, "web.lock"), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		running, err := GetRunningProxy("web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running != nil {
+			t.Errorf("expected no running proxy, got PID %d", running.PID)
+		}
+		if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+			t.Errorf("expected the stale pidfile to be removed, got %v", err)
+		}
+
+		// Stopping it mustn't signal this process.
+		if err := RunStopProxy(context.Background(), StopProxy, []string{"web"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStartProxyRespectsLock(t *testing.T) {
+	runDir, cleanup := withTempHome(t)
+	defer cleanup()
+
+	lock, err := lockProxy(runDir, "web")
+	if err != nil || lock == nil {
+		t.Fatalf("expected to take the lock, got %v", err)
+	}
+	defer lock.Close()
+
+	if other, err := lockProxy(runDir, "web"); err != nil || other != nil {
+		t.Fatalf("expected the lock to be held already, got %v, %v", other, err)
+	}
+
+	// A socket belonging to the proxy holding the lock is left alone.
+	socketPath := path.Join(runDir, "web.sock")
+	if err := ioutil.WriteFile(socketPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	*flStartProxyHost = "web"
+	defer func() { *flStartProxyHost = "" }()
+	if err := RunStartProxy(context.Background(), StartProxy, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Errorf("expected the running proxy's socket to be left alone, got %v", err)
+	}
+}
+
+// Not a real test: run by TestStopProxy as a stand-in for a running
+// proxy, which holds the lock and writes its pidfile.
+func TestHelperProxy(t *testing.T) {
+	if os.Getenv("ORCHARD_TEST_HELPER_PROXY") == "" {
+		return
+	}
+	runDir, err := GetRunDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := lockProxy(runDir, "web")
+	if err != nil || lock == nil {
+		t.Fatalf("couldn't take the lock: %v", err)
+	}
+	if err := writePidFile(path.Join(runDir, "web.pid")); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString("ready\n")
+	time.Sleep(time.Minute)
+}
+
+func TestStopProxy(t *testing.T) {
+	_, cleanup := withTempHome(t)
+	defer cleanup()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProxy$")
+	cmd.Env = append(os.Environ(), "ORCHARD_TEST_HELPER_PROXY=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	exited := make(chan error, 1)
+	go func() {
+		bufio.NewReader(stdout).ReadString('\n')
+		exited <- cmd.Wait()
+	}()
+
+	// Wait for the helper to be ready.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		running, err := GetRunningProxy("web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running != nil {
+			if running.PID != cmd.Process.Pid {
+				t.Fatalf("expected PID %d, got %d", cmd.Process.Pid, running.PID)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the helper proxy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := RunStopProxy(context.Background(), StopProxy, []string{"web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-exited:
+		status := err.(*exec.ExitError).Sys().(syscall.WaitStatus)
+		if !status.Signaled() || status.Signal() != syscall.SIGTERM {
+			t.Errorf("expected the helper to be stopped by SIGTERM, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the helper didn't exit")
+	}
+
+	if running, err := GetRunningProxy("web"); err != nil || running != nil {
+		t.Errorf("expected no running proxy after stopping it, got %v, %v", running, err)
+	}
+}
+
+func TestStopProcessAllowsForShutdown(t *testing.T) {
+	defer func(shutdown, cleanup time.Duration) {
+		ProxyShutdownTimeout, proxyCleanupTimeout = shutdown, cleanup
+	}(ProxyShutdownTimeout, proxyCleanupTimeout)
+	ProxyShutdownTimeout = 200 * time.Millisecond
+	proxyCleanupTimeout = 300 * time.Millisecond
+
+	stop := func(script string) (*exec.ExitError, time.Duration) {
+		cmd := exec.Command("sh", "-c", script)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		// Give the shell time to set its trap.
+		time.Sleep(100 * time.Millisecond)
+
+		var err error
+		done := false
+		start := time.Now()
+		stopped := func() bool {
+			if !done {
+				select {
+				case err = <-exited:
+					done = true
+				default:
+				}
+			}
+			return done
+		}
+		if err := stopProcess(context.Background(), cmd.Process.Pid, stopped); err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		if !done {
+			err = <-exited
+		}
+		exitErr, _ := err.(*exec.ExitError)
+		if exitErr == nil {
+			t.Fatalf("%s: expected the process to exit with an error, got %v", script, err)
+		}
+		return exitErr, elapsed
+	}
+
+	// Cleaning up after draining connections for the whole shutdown
+	// timeout isn't cut short.
+	exitErr, _ := stop("trap 'sleep 0.3; exit 7' TERM; while :; do sleep 0.05; done")
+	if exitErr.ExitCode() != 7 {
+		t.Errorf("expected the process to exit by itself, got %v", exitErr)
+	}
+
+	// A process that ignores SIGTERM is killed, but only after that.
+	exitErr, elapsed := stop("trap '' TERM; while :; do sleep 0.05; done")
+	status := exitErr.Sys().(syscall.WaitStatus)
+	if !status.Signaled() || status.Signal() != syscall.SIGKILL {
+		t.Errorf("expected the process to be killed, got %v", exitErr)
+	}
+	if elapsed < ProxyShutdownTimeout+proxyCleanupTimeout {
+		t.Errorf("expected it to be killed after %s, but it was after %s", ProxyShutdownTimeout+proxyCleanupTimeout, elapsed)
+	}
+}
@@ -0,0 +1,262 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var Env = &Command{
+	UsageLine: "env [-H HOST] [--shell SHELL] [--unset]",
+	Short:     "Print commands to point Docker at a host",
+	Long: `Print commands that set up your shell to use a host's Docker daemon
+directly over TLS, without a proxy:
+
+    $ eval $(orchard env)
+    $ docker ps
+
+The host's client certificate and key are written to
+~/.orchard/certs/HOST/, along with the CA certificate the daemon is
+verified against, and DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH
+are set to use them.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+
+--shell chooses the syntax of the commands: bash, zsh, fish or powershell.
+By default, it's guessed from $SHELL.
+
+Set --unset to print commands that clear the variables instead.
+`,
+}
+
+var flEnvHost = Env.Flag.String("H", "", "")
+var flEnvShell = Env.Flag.String("shell", "", "")
+var flEnvUnset = Env.Flag.Bool("unset", false, "")
+
+var envVars = []string{"DOCKER_HOST", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH"}
+
+func RunEnv(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard env` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+
+	shell := *flEnvShell
+	if shell == "" {
+		shell = DetectShell()
+	}
+	if _, ok := shellFormats[shell]; !ok {
+		return cmd.UsageError("Unsupported shell: %q", shell)
+	}
+
+	if *flEnvUnset {
+		for _, name := range envVars {
+			fmt.Println(UnsetEnvCommand(shell, name))
+		}
+		fmt.Println(shellFormats[shell].comment + "Run this command to configure your shell:")
+		fmt.Println(shellFormats[shell].comment + shellFormats[shell].eval(envCommand(shell, "--unset")))
+		return nil
+	}
+
+	hostName := *flEnvHost
+	if hostName == "" {
+		hostName = authenticator.DefaultHostName()
+	}
+
+	host, err := GetHost(ctx, hostName)
+	if err != nil {
+		return err
+	}
+
+	certDir, err := WriteHostCerts(host)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		"DOCKER_HOST":       "tcp://" + DockerAddress(host),
+		"DOCKER_TLS_VERIFY": "1",
+		"DOCKER_CERT_PATH":  certDir,
+	}
+	for _, name := range envVars {
+		fmt.Println(SetEnvCommand(shell, name, values[name]))
+	}
+
+	var hostArgs []string
+	if *flEnvHost != "" {
+		hostArgs = []string{"-H", *flEnvHost}
+	}
+	fmt.Println(shellFormats[shell].comment + "Run this command to configure your shell:")
+	fmt.Println(shellFormats[shell].comment + shellFormats[shell].eval(envCommand(shell, hostArgs...)))
+
+	return nil
+}
+
+// Returns the 'orchard env' command line with the given arguments, for
+// the current profile, quoted for the shell.
+func envCommand(shell string, args ...string) string {
+	words := []string{"orchard"}
+	for _, arg := range append(append(ProfileArgs(), "env"), args...) {
+		if !plainWord.MatchString(arg) {
+			arg = shellFormats[shell].quote(arg)
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// Words that no supported shell needs quoted.
+var plainWord = regexp.MustCompile(`^[A-Za-z0-9_./:=+-]+$`)
+
+type shellFormat struct {
+	set     func(name, value string) string
+	unset   func(name string) string
+	eval    func(command string) string
+	quote   func(s string) string
+	comment string
+}
+
+var shellFormats = map[string]shellFormat{
+	"bash": {
+		set:     func(name, value string) string { return fmt.Sprintf("export %s=%s", name, posixQuote(value)) },
+		unset:   func(name string) string { return fmt.Sprintf("unset %s", name) },
+		eval:    func(command string) string { return fmt.Sprintf("eval \"$(%s)\"", command) },
+		quote:   posixQuote,
+		comment: "# ",
+	},
+	"fish": {
+		set:     func(name, value string) string { return fmt.Sprintf("set -gx %s %s;", name, fishQuote(value)) },
+		unset:   func(name string) string { return fmt.Sprintf("set -e %s;", name) },
+		eval:    func(command string) string { return fmt.Sprintf("eval (%s)", command) },
+		quote:   fishQuote,
+		comment: "# ",
+	},
+	"powershell": {
+		set:     func(name, value string) string { return fmt.Sprintf("$Env:%s = %s", name, powershellQuote(value)) },
+		unset:   func(name string) string { return fmt.Sprintf("Remove-Item Env:\\%s", name) },
+		eval:    func(command string) string { return fmt.Sprintf("& %s | Invoke-Expression", command) },
+		quote:   powershellQuote,
+		comment: "# ",
+	},
+}
+
+// Quotes a string for POSIX shells. Nothing is special inside single
+// quotes, so a single quote is written by closing them, escaping it and
+// opening them again.
+func posixQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Quotes a string for fish, where backslashes and single quotes are
+// escaped with a backslash inside single quotes.
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// Quotes a string for PowerShell, where single quotes are escaped by
+// doubling them inside single quotes. PowerShell treats typographic
+// single quotes as quotes too.
+func powershellQuote(s string) string {
+	for _, quote := range []string{"'", "\u2018", "\u2019", "\u201a", "\u201b"} {
+		s = strings.Replace(s, quote, quote+quote, -1)
+	}
+	return "'" + s + "'"
+}
+
+func init() {
+	shellFormats["zsh"] = shellFormats["bash"]
+	shellFormats["sh"] = shellFormats["bash"]
+}
+
+func SetEnvCommand(shell, name, value string) string {
+	return shellFormats[shell].set(name, value)
+}
+
+func UnsetEnvCommand(shell, name string) string {
+	return shellFormats[shell].unset(name)
+}
+
+// Guesses the user's shell from $SHELL, falling back to bash.
+func DetectShell() string {
+	shell := filepath.Base(os.Getenv("SHELL"))
+	if _, ok := shellFormats[shell]; ok {
+		return shell
+	}
+	if shell == "pwsh" {
+		return "powershell"
+	}
+	return "bash"
+}
+
+// Returns the path to a directory under ~/.orchard, creating it if needed.
+func GetOrchardDir(elem ...string) (string, error) {
+	dir := path.Join(append([]string{os.Getenv("HOME"), ".orchard"}, elem...)...)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Like GetOrchardDir, but under ~/.orchard/profiles/NAME when a named
+// profile is in use, so that profiles' hosts don't collide.
+func GetProfileDir(elem ...string) (string, error) {
+	if name := authenticator.CurrentProfileName(); name != "" {
+		elem = append([]string{"profiles", name}, elem...)
+	}
+	return GetOrchardDir(elem...)
+}
+
+// Returns the global options that select the current profile, for
+// running orchard again in the background.
+func ProfileArgs() []string {
+	if name := authenticator.CurrentProfileName(); name != "" {
+		return []string{"--profile", name}
+	}
+	return []string{}
+}
+
+// Writes the host's client certificate and key, plus the CA certificate,
+// in the layout Docker expects for DOCKER_CERT_PATH. Returns the directory.
+func WriteHostCerts(host *api.Host) (string, error) {
+	certDir, err := GetProfileDir("certs", host.Name)
+	if err != nil {
+		return "", err
+	}
+
+	caData, err := tlsconfig.GetCACertificates(authenticator.HostCAFile())
+	if err != nil {
+		return "", err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{"ca.pem", caData, 0644},
+		{"cert.pem", []byte(host.ClientCert), 0644},
+		{"key.pem", []byte(host.ClientKey), 0600},
+	}
+
+	for _, file := range files {
+		filePath := path.Join(certDir, file.name)
+		if err := ioutil.WriteFile(filePath, file.data, file.mode); err != nil {
+			return "", err
+		}
+		// WriteFile doesn't change the mode of an existing file.
+		if err := os.Chmod(filePath, file.mode); err != nil {
+			return "", err
+		}
+	}
+
+	return certDir, nil
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"github.com/orchardup/go-orchard/authenticator"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+var awkwardValues = []string{
+	"/home/me/.orchard/certs/default",
+	"/home/John Smith/.orchard",
+	"/home/$USER/it's \"here\"",
+	`C:\Users\me\'x'\`,
+	"",
+}
+
+func TestSetEnvCommandPOSIX(t *testing.T) {
+	for _, value := range awkwardValues {
+		script := SetEnvCommand("sh", "DOCKER_CERT_PATH", value) + `; printf %s "$DOCKER_CERT_PATH"`
+		output, err := exec.Command("sh", "-c", script).Output()
+		if err != nil {
+			t.Fatalf("%s: %v", script, err)
+		}
+		if string(output) != value {
+			t.Errorf("%s: expected %q, got %q", script, value, output)
+		}
+	}
+}
+
+func TestSetEnvCommandQuoting(t *testing.T) {
+	tests := []struct {
+		shell, value, expected string
+	}{
+		{"bash", "/a b/$x", `export DOCKER_CERT_PATH='/a b/$x'`},
+		{"bash", "it's", `export DOCKER_CERT_PATH='it'\''s'`},
+		{"fish", "/a b/$x", `set -gx DOCKER_CERT_PATH '/a b/$x';`},
+		{"fish", `it's \`, `set -gx DOCKER_CERT_PATH 'it\'s \\';`},
+		{"powershell", "/a b/$x", `$Env:DOCKER_CERT_PATH = '/a b/$x'`},
+		{"powershell", "it's", `$Env:DOCKER_CERT_PATH = 'it''s'`},
+		{"powershell", "it\u2019s", "$Env:DOCKER_CERT_PATH = 'it\u2019\u2019s'"},
+	}
+	for _, test := range tests {
+		if actual := SetEnvCommand(test.shell, "DOCKER_CERT_PATH", test.value); actual != test.expected {
+			t.Errorf("%s, %q: expected %s, got %s", test.shell, test.value, test.expected, actual)
+		}
+	}
+}
+
+// Runs the commands through fish and PowerShell too, if they're installed.
+func TestSetEnvCommandOtherShells(t *testing.T) {
+	shells := map[string]func(script string) *exec.Cmd{
+		"fish": func(script string) *exec.Cmd {
+			return exec.Command("fish", "-c", script+`; printf %s "$DOCKER_CERT_PATH"`)
+		},
+		"powershell": func(script string) *exec.Cmd {
+			return exec.Command("pwsh", "-NoProfile", "-Command", script+"; [Console]::Out.Write($Env:DOCKER_CERT_PATH)")
+		},
+	}
+	for shell, command := range shells {
+		if _, err := exec.LookPath(command("").Path); err != nil {
+			continue
+		}
+		for _, value := range awkwardValues {
+			if value == "" && shell == "powershell" {
+				// Setting an environment variable to "" removes it.
+				continue
+			}
+			script := SetEnvCommand(shell, "DOCKER_CERT_PATH", value)
+			output, err := command(script).Output()
+			if err != nil {
+				t.Fatalf("%s: %s: %v", shell, script, err)
+			}
+			if string(output) != value {
+				t.Errorf("%s: %s: expected %q, got %q", shell, script, value, output)
+			}
+		}
+	}
+}
+
+func TestEnvCommand(t *testing.T) {
+	_, cleanup := withTempHome(t)
+	defer cleanup()
+
+	config := &authenticator.Config{Profiles: map[string]*authenticator.Profile{"work": {}}}
+	if err := config.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticator.SelectProfile("work"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.Remove(authenticator.GetConfigPath())
+		authenticator.SelectProfile("")
+	}()
+
+	// The hint is run as it's printed, so its arguments must survive the
+	// shell intact.
+	hostName := "web $(id) it's"
+	command := envCommand("sh", "-H", hostName)
+	output, err := exec.Command("sh", "-c", `orchard() { printf '%s\n' "$@"; }; `+command).Output()
+	if err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	if args := strings.Join([]string{"--profile", "work", "env", "-H", hostName, ""}, "\n"); string(output) != args {
+		t.Errorf("%s: expected the arguments %q, got %q", command, args, output)
+	}
+
+	tests := map[string]string{
+		"fish":       `orchard --profile work env -H 'web $(id) it\'s'`,
+		"powershell": `orchard --profile work env -H 'web $(id) it''s'`,
+	}
+	for shell, expected := range tests {
+		if command := envCommand(shell, "-H", hostName); command != expected {
+			t.Errorf("%s: expected %s, got %s", shell, expected, command)
+		}
+	}
+}
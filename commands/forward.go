@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/proxy"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var Forward = &Command{
+	UsageLine: "forward [-H HOST] LOCAL:CONTAINER:PORT",
+	Short:     "Forward a local port to a port inside a container",
+	Long: `Forward a local port to a port inside a container on a host, through
+the host's Docker daemon. Nothing needs to be published on the host, so
+this works wherever Orchard commands do:
+
+    $ orchard forward 5432:db:5432
+    Forwarding 127.0.0.1:5432 to port 5432 in container db
+
+    $ psql -h localhost -p 5432
+
+LOCAL is a port, or an address and port, to listen on. CONTAINER is the
+name or ID of a running container, and PORT is the port to connect to
+inside it.
+
+Each connection runs nc (or socat) inside the container with
+'docker exec', so the container needs one of them installed.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+`,
+}
+
+var flForwardHost = Forward.Flag.String("H", "", "")
+
+func init() {
+	Forward.Run = RunForward
+}
+
+func RunForward(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.UsageError("`orchard forward` expects 1 argument, but got %d", len(args))
+	}
+
+	listenAddr, container, port, err := ParseForwardSpec(args[0])
+	if err != nil {
+		return cmd.UsageError("%s", err)
+	}
+
+	hostName := *flForwardHost
+	if hostName == "" {
+		hostName = authenticator.DefaultHostName()
+	}
+
+	p, err := MakeProxy(ctx, "tcp", listenAddr, hostName)
+	if err != nil {
+		return fmt.Errorf("Error starting forwarding: %v", err)
+	}
+
+	dialer := &proxy.ExecDialer{
+		DialFunc:  p.DialFunc,
+		Container: container,
+		Cmd:       proxy.ForwardPortCmd(port),
+		Stderr:    os.Stderr,
+	}
+	if err := dialer.CheckContainer(); err != nil {
+		return err
+	}
+	p.DialFunc = dialer.Dial
+
+	if err := p.Listen(); err != nil {
+		return fmt.Errorf("Error starting forwarding: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- p.Serve(ctx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Forwarding %s to port %d in container %s\n", p.Listener.Addr(), port, container)
+
+	err = <-served
+	if err == proxy.ErrProxyClosed || err == ctx.Err() {
+		err = nil
+	}
+
+	fmt.Fprintln(os.Stderr, "\nStopping forwarding")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ProxyShutdownTimeout)
+	defer cancel()
+	p.Shutdown(shutdownCtx)
+
+	if err != nil {
+		return fmt.Errorf("Forwarding stopped with error: %v", err)
+	}
+	return nil
+}
+
+// ParseForwardSpec parses a LOCAL:CONTAINER:PORT argument. LOCAL can be
+// a port, which is listened on at 127.0.0.1, or an address and port.
+func ParseForwardSpec(spec string) (listenAddr, container string, port int, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 3 {
+		return "", "", 0, fmt.Errorf("Expected LOCAL:CONTAINER:PORT, but got %q", spec)
+	}
+
+	n := len(parts)
+	port, err = strconv.Atoi(parts[n-1])
+	if err != nil || port < 1 || port > 65535 {
+		return "", "", 0, fmt.Errorf("Invalid container port: %q", parts[n-1])
+	}
+
+	container = parts[n-2]
+	if container == "" {
+		return "", "", 0, fmt.Errorf("Expected LOCAL:CONTAINER:PORT, but got %q", spec)
+	}
+
+	local := strings.Join(parts[:n-2], ":")
+	if _, err := strconv.Atoi(local); err == nil {
+		local = net.JoinHostPort("127.0.0.1", local)
+	}
+	if _, _, err := net.SplitHostPort(local); err != nil {
+		return "", "", 0, fmt.Errorf("Invalid local address: %q", local)
+	}
+
+	return local, container, port, nil
+}
@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/orchardup/go-orchard/proxy"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// Returns the directory holding the CA and client certificate for
+// proxies started with --tls, which is what DOCKER_CERT_PATH should be
+// set to for Docker to use them.
+func GetProxyCertDir() (string, error) {
+	return GetOrchardDir("proxy-certs")
+}
+
+// Returns a TLS config for a proxy's listener that requires clients to
+// present a certificate signed by the proxy CA. The CA and a client
+// certificate are generated the first time, and the client certificate
+// again whenever the CA has to be; the server certificate is
+// generated each time, for this machine's current names and addresses.
+// It uses the standard library's TLS rather than the vendored fork, which
+// still allows SSLv3 and weak ciphers.
+func ProxyTLSConfig() (*tls.Config, error) {
+	certDir, err := GetProxyCertDir()
+	if err != nil {
+		return nil, err
+	}
+
+	caCertPEM, caKeyPEM, newCA, err := loadOrGenerate(path.Join(certDir, "ca.pem"), path.Join(certDir, "ca-key.pem"), false, func() ([]byte, []byte, error) {
+		return tlsconfig.GenerateCA("Orchard Proxy CA")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A client certificate signed by an earlier CA would be rejected.
+	_, _, _, err = loadOrGenerate(path.Join(certDir, "cert.pem"), path.Join(certDir, "key.pem"), newCA, func() ([]byte, []byte, error) {
+		return tlsconfig.GenerateCertificate(caCertPEM, caKeyPEM, "Orchard Proxy Client", nil, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	serverCertPEM, serverKeyPEM, err := tlsconfig.GenerateCertificate(caCertPEM, caKeyPEM, "Orchard Proxy", localHostNames(), false)
+	if err != nil {
+		return nil, err
+	}
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caCertPEM)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Reads a certificate and key, generating and saving them if they don't
+// exist yet, or if regenerate is set. Reports whether they were generated.
+func loadOrGenerate(certFile, keyFile string, regenerate bool, generate func() ([]byte, []byte, error)) ([]byte, []byte, bool, error) {
+	if !regenerate {
+		certPEM, certErr := ioutil.ReadFile(certFile)
+		keyPEM, keyErr := ioutil.ReadFile(keyFile)
+		if certErr == nil && keyErr == nil {
+			return certPEM, keyPEM, false, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generate()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, nil, false, err
+	}
+	// WriteFile leaves the mode of an existing key file alone.
+	if err := os.Chmod(keyFile, 0600); err != nil {
+		return nil, nil, false, err
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, nil, false, err
+	}
+	return certPEM, keyPEM, true, nil
+}
+
+// Returns the names and addresses this machine can be reached at.
+func localHostNames() []string {
+	names := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				names = append(names, ipNet.IP.String())
+			}
+		}
+	}
+	return names
+}
+
+// Reports whether a listen address can only be reached from this
+// machine: a Unix socket, or a TCP address on a loopback interface.
+func IsLoopbackListener(listenType, listenAddr string) bool {
+	if !strings.HasPrefix(listenType, "tcp") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Returns an error if a proxy would expose a Docker daemon beyond this
+// machine without any client authentication.
+func CheckListenerSecurity(listenURL string, opts *ProxyOptions) error {
+	if listenURL == "" || opts.TLS || opts.AuthToken != "" || opts.Insecure {
+		return nil
+	}
+	listenType, listenAddr, err := ListenArgs(listenURL)
+	if err != nil {
+		return err
+	}
+	if IsLoopbackListener(listenType, listenAddr) {
+		return nil
+	}
+	return fmt.Errorf(`Refusing to listen on %s without authentication, as anyone who can
+reach it would have root access to the host. Use --tls or --token to
+require clients to authenticate, or --insecure if you're sure.`, listenURL)
+}
+
+// Makes a proxy's listener require TLS client certificates, if the
+// options ask for it.
+func (opts *ProxyOptions) secureListener(p *proxy.Proxy) error {
+	if opts == nil || !opts.TLS || p.ListenFunc == nil {
+		return nil
+	}
+	config, err := ProxyTLSConfig()
+	if err != nil {
+		return fmt.Errorf("Error setting up TLS: %v", err)
+	}
+	listen := p.ListenFunc
+	p.ListenFunc = func() (net.Listener, error) {
+		listener, err := listen()
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(listener, config), nil
+	}
+	return nil
+}
+
+// Prints how to point Docker at a proxy.
+func PrintProxyUsage(listenURL string, opts *ProxyOptions) {
+	fmt.Fprintf(os.Stderr, "Started proxy. Use it by setting your Docker host:\n%s\n", SetEnvCommand("sh", "DOCKER_HOST", listenURL))
+	if opts != nil && opts.TLS {
+		certDir, _ := GetProxyCertDir()
+		fmt.Fprintf(os.Stderr, "%s\n%s\n", SetEnvCommand("sh", "DOCKER_TLS_VERIFY", "1"), SetEnvCommand("sh", "DOCKER_CERT_PATH", certDir))
+	}
+	if opts != nil && opts.AuthToken != "" {
+		fmt.Fprintln(os.Stderr, `Requests must carry the token in an "Authorization: Bearer TOKEN" header,
+which Docker sends if it's in the "HttpHeaders" section of ~/.docker/config.json.`)
+	}
+}
@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"crypto/x509"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestProxyTLSConfigReplacesClientCertWithCA(t *testing.T) {
+	_, cleanup := withTempHome(t)
+	defer cleanup()
+
+	certDir, err := GetProxyCertDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Checks that the client certificate is signed by the current CA.
+	verify := func() []byte {
+		if _, err := ProxyTLSConfig(); err != nil {
+			t.Fatal(err)
+		}
+		caPEM, err := ioutil.ReadFile(path.Join(certDir, "ca.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPEM, err := ioutil.ReadFile(path.Join(certDir, "cert.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tlsconfig.ParseCertificate(certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(caPEM)
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+			t.Errorf("the client certificate isn't signed by the CA: %v", err)
+		}
+		return certPEM
+	}
+
+	first := verify()
+	if again := verify(); string(again) != string(first) {
+		t.Error("expected the client certificate to be kept while the CA is")
+	}
+
+	if err := os.Remove(path.Join(certDir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if replaced := verify(); string(replaced) == string(first) {
+		t.Error("expected a new client certificate for the new CA")
+	}
+}
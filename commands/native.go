@@ -0,0 +1,347 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/docker"
+	"github.com/orchardup/go-orchard/orchard"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"github.com/orchardup/go-orchard/utils"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var PS = &Command{
+	UsageLine: "ps [-H HOST] [-a] [-q] [--format FORMAT]",
+	Short:     "List containers on a host",
+	Long: `List the running containers on a host, or all of them if -a is set.
+Set -q to only print their IDs.
+
+Like 'orchard images', 'orchard logs', 'orchard stop' and 'orchard info',
+this talks to the host's Docker daemon directly, so it works without the
+docker command installed.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+
+` + formatUsage,
+}
+
+var Images = &Command{
+	UsageLine: "images [-H HOST] [-q] [--format FORMAT]",
+	Short:     "List images on a host",
+	Long: `List the images on a host. Set -q to only print their IDs.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+
+` + formatUsage,
+}
+
+var Logs = &Command{
+	UsageLine: "logs [-H HOST] [-f] [-t] [--tail N] CONTAINER",
+	Short:     "Print a container's logs",
+	Long: `Print the output of a container on a host. Set -f to keep printing new
+output until the container exits, -t to show timestamps, and --tail to
+only print the last N lines.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+`,
+}
+
+var Stop = &Command{
+	UsageLine: "stop [-H HOST] [-t SECONDS] CONTAINER...",
+	Short:     "Stop containers on a host",
+	Long: `Stop running containers on a host. Each container is sent SIGTERM, and
+killed if it hasn't exited after -t seconds (10 by default).
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+`,
+}
+
+var Info = &Command{
+	UsageLine: "info [-H HOST] [--format FORMAT]",
+	Short:     "Show information about a host's Docker daemon",
+	Long: `Show information about a host's Docker daemon, such as how many
+containers and images it has.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+
+` + formatUsage,
+}
+
+var flPSHost = PS.Flag.String("H", "", "")
+var flPSAll = PS.Flag.Bool("a", false, "")
+var flPSQuiet = PS.Flag.Bool("q", false, "")
+var flPSFormat = FormatFlag(PS)
+
+var flImagesHost = Images.Flag.String("H", "", "")
+var flImagesQuiet = Images.Flag.Bool("q", false, "")
+var flImagesFormat = FormatFlag(Images)
+
+var flLogsHost = Logs.Flag.String("H", "", "")
+var flLogsFollow = Logs.Flag.Bool("f", false, "")
+var flLogsTimestamps = Logs.Flag.Bool("t", false, "")
+var flLogsTail = Logs.Flag.String("tail", "all", "")
+
+var flStopHost = Stop.Flag.String("H", "", "")
+var flStopTimeout = Stop.Flag.Int("t", 10, "")
+
+var flInfoHost = Info.Flag.String("H", "", "")
+var flInfoFormat = FormatFlag(Info)
+
+func init() {
+	PS.Run = RunPS
+	Images.Run = RunImages
+	Logs.Run = RunLogs
+	Stop.Run = RunStop
+	Info.Run = RunInfo
+}
+
+// Returns a Docker API client for a host's Docker daemon.
+func DockerClient(ctx context.Context, hostName string) (*docker.Client, error) {
+	if hostName == "" {
+		hostName = authenticator.DefaultHostName()
+	}
+	host, err := GetHost(ctx, hostName)
+	if err != nil {
+		return nil, err
+	}
+	// Checks the host's certificates up front.
+	if _, err := tlsconfig.GetTLSConfig([]byte(host.ClientCert), []byte(host.ClientKey), authenticator.HostCAFile()); err != nil {
+		return nil, err
+	}
+	return docker.NewClient(func(ctx context.Context) (net.Conn, error) {
+		return orchard.DialHost(ctx, host)
+	}), nil
+}
+
+func RunPS(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard ps` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	if err := ValidateFormat(*flPSFormat); err != nil {
+		return err
+	}
+
+	client, err := DockerClient(ctx, *flPSHost)
+	if err != nil {
+		return err
+	}
+	containers, err := client.ListContainers(ctx, *flPSAll)
+	if err != nil {
+		return err
+	}
+
+	return WriteOutput(os.Stdout, *flPSFormat, containers, func(w io.Writer) error {
+		if *flPSQuiet {
+			for _, container := range containers {
+				fmt.Fprintln(w, shortID(container.ID))
+			}
+			return nil
+		}
+
+		writer := tabwriter.NewWriter(w, 20, 1, 3, ' ', 0)
+		fmt.Fprintln(writer, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tPORTS\tNAMES")
+		for _, container := range containers {
+			ports := []string{}
+			for _, port := range container.Ports {
+				ports = append(ports, port.String())
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%q\t%s\t%s\t%s\t%s\n",
+				shortID(container.ID),
+				container.Image,
+				truncate(container.Command, 20),
+				createdAgo(container.Created),
+				container.Status,
+				strings.Join(ports, ", "),
+				container.Name(),
+			)
+		}
+		return writer.Flush()
+	})
+}
+
+func RunImages(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard images` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	if err := ValidateFormat(*flImagesFormat); err != nil {
+		return err
+	}
+
+	client, err := DockerClient(ctx, *flImagesHost)
+	if err != nil {
+		return err
+	}
+	images, err := client.ListImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	return WriteOutput(os.Stdout, *flImagesFormat, images, func(w io.Writer) error {
+		if *flImagesQuiet {
+			for _, image := range images {
+				fmt.Fprintln(w, shortID(image.ID))
+			}
+			return nil
+		}
+
+		writer := tabwriter.NewWriter(w, 20, 1, 3, ' ', 0)
+		fmt.Fprintln(writer, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tVIRTUAL SIZE")
+		for _, image := range images {
+			tags := image.RepoTags
+			if len(tags) == 0 {
+				tags = []string{"<none>:<none>"}
+			}
+			for _, tag := range tags {
+				repository, tagName := tag, ""
+				if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+					repository, tagName = tag[:i], tag[i+1:]
+				}
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+					repository,
+					tagName,
+					shortID(image.ID),
+					createdAgo(image.Created),
+					utils.HumanSize(image.VirtualSize),
+				)
+			}
+		}
+		return writer.Flush()
+	})
+}
+
+func RunLogs(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.UsageError("`orchard logs` expects 1 argument, but got %d", len(args))
+	}
+	if !validTail(*flLogsTail) {
+		return cmd.UsageError("--tail must be a number of lines or 'all', but got %q", *flLogsTail)
+	}
+
+	client, err := DockerClient(ctx, *flLogsHost)
+	if err != nil {
+		return err
+	}
+
+	opts := docker.LogsOptions{
+		Follow:     *flLogsFollow,
+		Timestamps: *flLogsTimestamps,
+		Tail:       *flLogsTail,
+	}
+	err = client.Logs(ctx, args[0], opts, os.Stdout, os.Stderr)
+	if err == context.Canceled && opts.Follow {
+		// Stopped following with Ctrl-C.
+		return nil
+	}
+	return err
+}
+
+func RunStop(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) < 1 {
+		return cmd.UsageError("`orchard stop` expects at least 1 argument")
+	}
+
+	client, err := DockerClient(ctx, *flStopHost)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, container := range args {
+		if err := client.StopContainer(ctx, container, *flStopTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error stopping %s: %s\n", container, err)
+			failed = true
+			continue
+		}
+		fmt.Println(container)
+	}
+	if failed {
+		return fmt.Errorf("Some containers couldn't be stopped")
+	}
+	return nil
+}
+
+func RunInfo(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard info` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	if err := ValidateFormat(*flInfoFormat); err != nil {
+		return err
+	}
+
+	client, err := DockerClient(ctx, *flInfoHost)
+	if err != nil {
+		return err
+	}
+	info, err := client.Info(ctx)
+	if err != nil {
+		return err
+	}
+
+	return WriteOutput(os.Stdout, *flInfoFormat, info, func(w io.Writer) error {
+		writer := tabwriter.NewWriter(w, 0, 1, 3, ' ', 0)
+		fmt.Fprintf(writer, "Containers:\t%d\n", info.Containers)
+		fmt.Fprintf(writer, "Images:\t%d\n", info.Images)
+		if info.ServerVersion != "" {
+			fmt.Fprintf(writer, "Server version:\t%s\n", info.ServerVersion)
+		}
+		fmt.Fprintf(writer, "Storage driver:\t%s\n", info.Driver)
+		if info.ExecutionDriver != "" {
+			fmt.Fprintf(writer, "Execution driver:\t%s\n", info.ExecutionDriver)
+		}
+		fmt.Fprintf(writer, "Kernel version:\t%s\n", info.KernelVersion)
+		if info.OperatingSystem != "" {
+			fmt.Fprintf(writer, "Operating system:\t%s\n", info.OperatingSystem)
+		}
+		if info.NCPU != 0 {
+			fmt.Fprintf(writer, "CPUs:\t%d\n", info.NCPU)
+		}
+		if info.MemTotal != 0 {
+			fmt.Fprintf(writer, "Total memory:\t%s\n", utils.HumanSize(info.MemTotal))
+		}
+		if info.Name != "" {
+			fmt.Fprintf(writer, "Name:\t%s\n", info.Name)
+		}
+		return writer.Flush()
+	})
+}
+
+// Returns the short form of a container or image ID.
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	return truncate(id, 12)
+}
+
+// Shortens s to at most length characters, not bytes, so that
+// multi-byte characters aren't split.
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) > length {
+		return string(runes[:length])
+	}
+	return s
+}
+
+func createdAgo(created int64) string {
+	return utils.HumanDuration(time.Since(time.Unix(created, 0))) + " ago"
+}
+
+// Checks a --tail value: a number of lines, or "all".
+func validTail(tail string) bool {
+	if tail == "all" {
+		return true
+	}
+	n, err := strconv.Atoi(tail)
+	return err == nil && n >= 0
+}
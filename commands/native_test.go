@@ -0,0 +1,24 @@
+package commands
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s, expected string
+	}{
+		{"abcdef", "abc"},
+		{"ab", "ab"},
+		{"héllo", "hél"},
+		{"日本語のコマンド", "日本語"},
+		{"🐳🐳🐳🐳", "🐳🐳🐳"},
+	}
+	for _, test := range tests {
+		actual := truncate(test.s, 3)
+		if actual != test.expected || !utf8.ValidString(actual) {
+			t.Errorf("truncate(%q, 3): expected %q, got %q", test.s, test.expected, actual)
+		}
+	}
+}
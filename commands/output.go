@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"github.com/orchardup/go-orchard/utils"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+var TemplateFuncs = template.FuncMap{
+	"trim":      strings.TrimSpace,
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"join":      strings.Join,
+	"humanSize": utils.HumanSize,
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Returns a template that can use TemplateFuncs.
+func NewTemplate(name string) *template.Template {
+	return template.New(name).Funcs(TemplateFuncs)
+}
+
+var formatUsage = `Set --format to choose how output is printed: 'table' (the default),
+'json', 'yaml', or a Go template such as '{{.Name}} {{.IPAddress}}'.`
+
+// Binds a --format flag to the given commands.
+func FormatFlag(cmds ...*Command) *string {
+	format := new(string)
+	for _, cmd := range cmds {
+		cmd.Flag.StringVar(format, "format", "table", "")
+	}
+	return format
+}
+
+// Checks that a --format value is a known format or a valid template.
+func ValidateFormat(format string) error {
+	switch format {
+	case "", "table", "json", "yaml":
+		return nil
+	}
+	if !strings.Contains(format, "{{") {
+		return fmt.Errorf("Unknown format %q. Use 'table', 'json', 'yaml' or a Go template.", format)
+	}
+	_, err := NewTemplate("format").Parse(format)
+	if err != nil {
+		return fmt.Errorf("Invalid format template: %s", err)
+	}
+	return nil
+}
+
+// Writes v in the given format. For the default table format, table is
+// called to do the writing. Templates are executed once per element if
+// v is a slice.
+func WriteOutput(w io.Writer, format string, v interface{}, table func(io.Writer) error) error {
+	switch format {
+	case "", "table":
+		return table(w)
+
+	case "json":
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+
+	case "yaml":
+		data, err := utils.MarshalYAML(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	t := template.Must(NewTemplate("format").Parse(format))
+
+	items := []interface{}{v}
+	if value := reflect.ValueOf(v); value.Kind() == reflect.Slice {
+		items = make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = value.Index(i).Interface()
+		}
+	}
+
+	for _, item := range items {
+		if err := t.Execute(w, item); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// HostInfo is the view of a host printed by commands. It leaves out the
+// host's client key and certificate.
+type HostInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	URL       string     `json:"url"`
+	Size      int64      `json:"size"`
+	IPAddress string     `json:"ip_address"`
+	Status    string     `json:"status,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+func NewHostInfo(host *api.Host) *HostInfo {
+	info := &HostInfo{
+		ID:        host.ID,
+		Name:      host.Name,
+		URL:       host.URL,
+		Size:      host.Size,
+		IPAddress: host.IPAddress,
+		Status:    host.Status,
+	}
+	if !host.CreatedAt.IsZero() {
+		createdAt := host.CreatedAt
+		info.CreatedAt = &createdAt
+	}
+	return info
+}
+
+// Human-readable RAM size, e.g. "512M".
+func (info *HostInfo) HumanSize() string {
+	return utils.HumanSize(info.Size * 1024 * 1024)
+}
+
+// HostDetails is the full view of a host printed by `hosts inspect`.
+type HostDetails struct {
+	*HostInfo
+	ClientCert *CertificateInfo `json:"client_cert"`
+	ClientKey  string           `json:"client_key"`
+}
+
+const redacted = "REDACTED"
+
+func NewHostDetails(host *api.Host, showSecrets bool) *HostDetails {
+	details := &HostDetails{
+		HostInfo:   NewHostInfo(host),
+		ClientCert: NewCertificateInfo(host.ClientCert),
+		ClientKey:  redacted,
+	}
+	if showSecrets {
+		details.ClientKey = host.ClientKey
+	}
+	return details
+}
+
+func (details *HostDetails) WriteTable(w io.Writer) error {
+	writer := tabwriter.NewWriter(w, 0, 1, 3, ' ', 0)
+	fmt.Fprintf(writer, "Name:\t%s\n", details.Name)
+	fmt.Fprintf(writer, "ID:\t%s\n", details.ID)
+	fmt.Fprintf(writer, "URL:\t%s\n", details.URL)
+	fmt.Fprintf(writer, "Size:\t%s\n", details.HumanSize())
+	fmt.Fprintf(writer, "IP:\t%s\n", details.IPAddress)
+	if details.Status != "" {
+		fmt.Fprintf(writer, "Status:\t%s\n", details.Status)
+	}
+	if details.CreatedAt != nil {
+		fmt.Fprintf(writer, "Created:\t%s\n", details.CreatedAt.Format(time.RFC1123))
+	}
+
+	cert := details.ClientCert
+	if cert.Error != "" {
+		fmt.Fprintf(writer, "Client certificate:\t%s\n", cert.Error)
+	} else {
+		fmt.Fprintf(writer, "Client certificate subject:\t%s\n", cert.Subject)
+		fmt.Fprintf(writer, "Client certificate issuer:\t%s\n", cert.Issuer)
+		fmt.Fprintf(writer, "Client certificate fingerprint:\t%s\n", cert.Fingerprint)
+		fmt.Fprintf(writer, "Client certificate expires:\t%s\n", cert.NotAfter.Format(time.RFC1123))
+	}
+
+	if details.ClientKey == redacted {
+		fmt.Fprintf(writer, "Client key:\t%s\n", redacted)
+	} else {
+		fmt.Fprintf(writer, "Client key:\t\n%s\n", strings.TrimSpace(details.ClientKey))
+	}
+	return writer.Flush()
+}
+
+// CertificateInfo describes a PEM-encoded certificate. If it can't be
+// parsed, only Error and PEM are set.
+type CertificateInfo struct {
+	Subject      string    `json:"subject,omitempty"`
+	Issuer       string    `json:"issuer,omitempty"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	Fingerprint  string    `json:"fingerprint,omitempty"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	Error        string    `json:"error,omitempty"`
+	PEM          string    `json:"pem"`
+}
+
+func NewCertificateInfo(pemData string) *CertificateInfo {
+	info := &CertificateInfo{PEM: pemData}
+
+	cert, err := tlsconfig.ParseCertificate([]byte(pemData))
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	info.Subject = cert.Subject.String()
+	info.Issuer = cert.Issuer.String()
+	info.SerialNumber = cert.SerialNumber.String()
+	info.Fingerprint = tlsconfig.Fingerprint(cert)
+	info.NotBefore = cert.NotBefore
+	info.NotAfter = cert.NotAfter
+	return info
+}
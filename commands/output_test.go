@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"bytes"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"strings"
+	"testing"
+)
+
+func TestHostDetailsRedactsClientKey(t *testing.T) {
+	certPEM, keyPEM, err := tlsconfig.GenerateCA("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := &api.Host{Name: "web", ClientCert: string(certPEM), ClientKey: string(keyPEM)}
+
+	for _, showSecrets := range []bool{false, true} {
+		details := NewHostDetails(host, showSecrets)
+		for _, format := range []string{"table", "json", "yaml", "{{.ClientKey}}"} {
+			var output bytes.Buffer
+			if err := WriteOutput(&output, format, details, details.WriteTable); err != nil {
+				t.Fatal(err)
+			}
+			hasKey := strings.Contains(output.String(), "PRIVATE KEY")
+			if hasKey != showSecrets {
+				t.Errorf("secrets %v, format %s: expected the key to be shown only with secrets, got:\n%s", showSecrets, format, output.String())
+			}
+			if !showSecrets && !strings.Contains(output.String(), redacted) {
+				t.Errorf("format %s: expected the key to be marked as redacted, got:\n%s", format, output.String())
+			}
+		}
+	}
+}
+
+func TestCertificateInfo(t *testing.T) {
+	certPEM, _, err := tlsconfig.GenerateCA("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tlsconfig.ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := NewCertificateInfo(string(certPEM))
+	if info.Error != "" {
+		t.Fatal(info.Error)
+	}
+	if info.Fingerprint != tlsconfig.Fingerprint(cert) || !info.NotAfter.Equal(cert.NotAfter) || !strings.Contains(info.Subject, "CN=web") {
+		t.Errorf("unexpected certificate info: %+v", info)
+	}
+
+	info = NewCertificateInfo("not a certificate")
+	if info.Error == "" || info.Fingerprint != "" || info.PEM != "not a certificate" {
+		t.Errorf("expected only the error and PEM for an invalid certificate, got %+v", info)
+	}
+}
@@ -0,0 +1,273 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/orchardup/go-orchard/authenticator"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+var Profile = &Command{
+	UsageLine: "profile [--format FORMAT]",
+	Short:     "Manage profiles for other accounts and APIs",
+	Long: `Manage profiles, which are named sets of settings kept in
+~/.orchard/config for using more than one Orchard account or API.
+
+Usage: orchard profile [--format FORMAT] [COMMAND] [ARGS...]
+
+Commands:
+  ls          List profiles (default)
+  use         Make a profile current
+  add         Add a profile
+  rm          Remove a profile
+
+Run 'orchard profile COMMAND -h' for more information on a command.
+
+Commands use the current profile, unless you select another with
+'orchard --profile NAME COMMAND' or ORCHARD_PROFILE. Each profile has its
+own saved API token, so 'orchard login' logs in to the profile in use.
+ORCHARD_API_URL, ORCHARD_API_TOKEN and ORCHARD_HOST_CA still override a
+profile's settings.
+`,
+}
+
+var ListProfiles = &Command{
+	UsageLine: "ls [--format FORMAT]",
+	Short:     "List profiles",
+	Long: `List profiles. The current one is marked with '*'.
+
+` + formatUsage,
+}
+
+var flProfilesFormat = FormatFlag(Profile, ListProfiles)
+
+var UseProfile = &Command{
+	UsageLine: "use NAME",
+	Short:     "Make a profile current",
+	Long: `Make a profile the one commands use, unless they're given --profile or
+ORCHARD_PROFILE is set.
+`,
+}
+
+var AddProfile = &Command{
+	UsageLine: "add [--api-url URL] [--token-env VAR] [--default-host HOST] [--host-ca FILE] NAME",
+	Short:     "Add a profile",
+	Long: `Add a profile. Settings you leave out fall back to Orchard's defaults.
+
+Options:
+  --api-url URL         Orchard API to use
+  --token-env VAR       Environment variable holding the API token, instead
+                        of the token saved by 'orchard login'
+  --default-host HOST   Host to use when commands aren't given one, instead
+                        of 'default'
+  --host-ca FILE        CA certificates to verify hosts against, instead of
+                        Orchard's own
+
+Then run 'orchard --profile NAME login' to log in with it, unless it uses
+--token-env.
+`,
+}
+
+var flAddProfileAPIURL = AddProfile.Flag.String("api-url", "", "")
+var flAddProfileTokenEnv = AddProfile.Flag.String("token-env", "", "")
+var flAddProfileDefaultHost = AddProfile.Flag.String("default-host", "", "")
+var flAddProfileHostCA = AddProfile.Flag.String("host-ca", "", "")
+
+var RemoveProfile = &Command{
+	UsageLine: "rm NAME",
+	Short:     "Remove a profile",
+	Long: `Remove a profile, along with the API tokens saved for it.
+`,
+}
+
+var ProfileSubcommands = []*Command{
+	ListProfiles,
+	UseProfile,
+	AddProfile,
+	RemoveProfile,
+}
+
+func init() {
+	Profile.Run = RunProfile
+	ListProfiles.Run = RunListProfiles
+	UseProfile.Run = RunUseProfile
+	AddProfile.Run = RunAddProfile
+	RemoveProfile.Run = RunRemoveProfile
+}
+
+// A profile as listed by 'orchard profile ls'.
+type ProfileInfo struct {
+	*authenticator.Profile
+	Name    string `json:"name"`
+	Current bool   `json:"current"`
+}
+
+func RunProfile(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) == 0 {
+		return RunListProfiles(ctx, ListProfiles, args)
+	}
+
+	for _, subcommand := range ProfileSubcommands {
+		if subcommand.Name() == args[0] {
+			subcommand.Flag.Usage = func() { subcommand.Usage() }
+			subcommand.Flag.Parse(args[1:])
+			args = subcommand.Flag.Args()
+			return subcommand.Run(ctx, subcommand, args)
+		}
+	}
+
+	return fmt.Errorf("Unknown `profile` subcommand: %s", args[0])
+}
+
+func RunListProfiles(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard profile ls` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+
+	if err := ValidateFormat(*flProfilesFormat); err != nil {
+		return err
+	}
+
+	config, err := authenticator.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	infos := []*ProfileInfo{}
+	for _, name := range config.ProfileNames() {
+		infos = append(infos, &ProfileInfo{
+			Profile: config.Profiles[name],
+			Name:    name,
+			Current: name == config.Current,
+		})
+	}
+
+	return WriteOutput(os.Stdout, *flProfilesFormat, infos, func(w io.Writer) error {
+		writer := tabwriter.NewWriter(w, 20, 1, 3, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tAPI URL\tDEFAULT HOST")
+		for _, info := range infos {
+			name := info.Name
+			if info.Current {
+				name += " *"
+			}
+			apiURL := info.APIURL
+			if apiURL == "" {
+				apiURL = authenticator.DefaultAPIURL
+			}
+			defaultHost := info.DefaultHost
+			if defaultHost == "" {
+				defaultHost = "default"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", name, apiURL, defaultHost)
+		}
+		return writer.Flush()
+	})
+}
+
+func RunUseProfile(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.UsageError("`orchard profile use` expects 1 argument: the name of a profile")
+	}
+
+	config, err := authenticator.LoadConfig()
+	if err != nil {
+		return err
+	}
+	name := args[0]
+	if _, ok := config.Profiles[name]; !ok {
+		return fmt.Errorf("No profile named %q. See 'orchard profile ls'.", name)
+	}
+
+	config.Current = name
+	if err := config.Save(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Using profile %s\n", name)
+	if os.Getenv("ORCHARD_PROFILE") != "" {
+		fmt.Fprintln(os.Stderr, "ORCHARD_PROFILE is set, so commands will use it instead until you unset it.")
+	}
+	return nil
+}
+
+func RunAddProfile(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.UsageError("`orchard profile add` expects 1 argument: the name of the profile")
+	}
+
+	name := args[0]
+	if err := authenticator.ValidateProfileName(name); err != nil {
+		return err
+	}
+
+	hostCA := *flAddProfileHostCA
+	if hostCA != "" {
+		// Commands can be run from anywhere, so a relative path would
+		// only work by chance.
+		absPath, err := filepath.Abs(hostCA)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(absPath); err != nil {
+			return err
+		}
+		hostCA = absPath
+	}
+
+	config, err := authenticator.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if _, ok := config.Profiles[name]; ok {
+		return fmt.Errorf("There's already a profile named %q. Remove it first with 'orchard profile rm %s'.", name, name)
+	}
+
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]*authenticator.Profile)
+	}
+	config.Profiles[name] = &authenticator.Profile{
+		APIURL:      strings.TrimRight(*flAddProfileAPIURL, "/"),
+		TokenEnv:    *flAddProfileTokenEnv,
+		DefaultHost: *flAddProfileDefaultHost,
+		HostCA:      hostCA,
+	}
+	if err := config.Save(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Added profile %s. Use it with 'orchard --profile %s COMMAND', or make it current with 'orchard profile use %s'.\n", name, name, name)
+	return nil
+}
+
+func RunRemoveProfile(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.UsageError("`orchard profile rm` expects 1 argument: the name of a profile")
+	}
+
+	config, err := authenticator.LoadConfig()
+	if err != nil {
+		return err
+	}
+	name := args[0]
+	if _, ok := config.Profiles[name]; !ok {
+		return fmt.Errorf("No profile named %q. See 'orchard profile ls'.", name)
+	}
+
+	delete(config.Profiles, name)
+	if config.Current == name {
+		config.Current = ""
+	}
+	if err := config.Save(); err != nil {
+		return err
+	}
+	if err := authenticator.DeleteProfileTokens(name); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Removed profile %s\n", name)
+	return nil
+}
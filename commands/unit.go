@@ -0,0 +1,307 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/orchardup/go-orchard/authenticator"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var InstallUnit = &Command{
+	UsageLine: "install-unit [-H HOST] [--listen ADDR] [--idle-timeout DURATION] [--dir DIR]",
+	Short:     "Install systemd units that start a proxy on first use",
+	Long: `Install a systemd socket and service for a host's proxy, so that systemd
+listens on the proxy's socket and starts the proxy when something first
+connects to it:
+
+    $ orchard proxy install-unit
+    $ systemctl --user daemon-reload
+    $ systemctl --user enable --now orchard-proxy-default.socket
+    $ export DOCKER_HOST=unix://$XDG_RUNTIME_DIR/orchard-default.sock
+
+The proxy exits once it's had no connections for --idle-timeout (10m by
+default; 0 keeps it running), and is started again on the next one.
+
+The socket is at $XDG_RUNTIME_DIR/orchard-HOST.sock unless you set
+--listen to another path, or to a TCP address such as localhost:2375.
+TCP addresses must be loopback ones, as the proxy doesn't require clients
+to authenticate.
+
+The proxy gets the token store and the ORCHARD_API_URL, ORCHARD_HOST_CA,
+ORCHARD_API_TOKEN_FILE, ORCHARD_USERNAME and ORCHARD_PASSWORD_FILE settings
+in use when the units are installed. Tokens and passphrases themselves
+aren't written to the units, so it can't use ORCHARD_API_TOKEN or read
+tokens saved in the encrypted file; use ORCHARD_API_TOKEN_FILE instead.
+
+The units are written to ~/.config/systemd/user, or to --dir. With a
+named profile in use, its name is part of the units' and socket's names,
+e.g. orchard-proxy-work-default.socket.
+
+You can optionally specify a host by name - if you don't, the default host
+will be used.
+`,
+}
+
+var flInstallUnitHost = InstallUnit.Flag.String("H", "", "")
+var flInstallUnitListen = InstallUnit.Flag.String("listen", "", "")
+var flInstallUnitIdleTimeout = InstallUnit.Flag.Duration("idle-timeout", 10*time.Minute, "")
+var flInstallUnitDir = InstallUnit.Flag.String("dir", "", "")
+
+func init() {
+	InstallUnit.Run = RunInstallUnit
+}
+
+var socketUnitTemplate = template.Must(template.New("socket").Parse(`[Unit]
+Description=Orchard proxy socket for {{.HumanName}}
+
+[Socket]
+ListenStream={{.ListenStream}}
+{{- if .SocketPath}}
+SocketMode=0600
+{{- end}}
+
+[Install]
+WantedBy=sockets.target
+`))
+
+var serviceUnitTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=Orchard proxy for {{.HumanName}}
+Requires={{.Name}}.socket
+After={{.Name}}.socket network-online.target
+
+[Service]
+ExecStart={{.ExecStart}}
+{{- range .Environment}}
+Environment={{.}}
+{{- end}}
+`))
+
+// ProxyUnit describes the systemd units for a host's socket-activated
+// proxy.
+type ProxyUnit struct {
+	Name      string
+	HumanName string
+
+	// ListenStream is the socket's path or TCP address, as systemd
+	// expects it. SocketPath is set if it's a Unix socket, and may start
+	// with systemd's %t for the runtime directory.
+	ListenStream string
+	SocketPath   string
+
+	ExecStart   string
+	Environment []string
+}
+
+// Environment variables passed on to proxy units, which affect how they
+// authenticate with the API and verify hosts. Paths are made absolute, as
+// systemd doesn't run proxies in the current directory.
+var unitEnvironment = []struct {
+	name   string
+	isPath bool
+}{
+	{"ORCHARD_API_URL", false},
+	{"ORCHARD_API_TOKEN_FILE", true},
+	{"ORCHARD_USERNAME", false},
+	{"ORCHARD_PASSWORD_FILE", true},
+	{"ORCHARD_HOST_CA", true},
+}
+
+// Returns the units for a proxy to a host, listening on listen (a path or
+// TCP address, or "" for the default path) and exiting after idleTimeout
+// without connections.
+func NewProxyUnit(hostName, listen string, idleTimeout time.Duration, executable string) (*ProxyUnit, error) {
+	// Units for different profiles' hosts of the same name mustn't clash.
+	unitHostName := hostName
+	if profile := authenticator.CurrentProfileName(); profile != "" {
+		unitHostName = profile + "-" + hostName
+	}
+
+	unit := &ProxyUnit{
+		Name:      "orchard-proxy-" + unitHostName,
+		HumanName: GetHumanHostName(hostName),
+	}
+
+	switch {
+	case listen == "":
+		unit.ListenStream = "%t/orchard-" + unitHostName + ".sock"
+		unit.SocketPath = unit.ListenStream
+	case strings.HasPrefix(listen, "/"):
+		unit.ListenStream = listen
+		unit.SocketPath = listen
+	default:
+		if !IsLoopbackListener("tcp", listen) {
+			return nil, fmt.Errorf("Refusing to listen on %s, as anyone who can reach it would have root access to the host. Use a Unix socket or a loopback address.", listen)
+		}
+		unit.ListenStream = listen
+	}
+
+	args := append(append([]string{executable}, ProfileArgs()...), "proxy", "-H", hostName)
+	if idleTimeout > 0 {
+		args = append(args, "--idle-timeout", idleTimeout.String())
+	}
+	args = append(args, "fd://")
+	for i, arg := range args {
+		args[i] = systemdQuote(arg)
+	}
+	unit.ExecStart = strings.Join(args, " ")
+
+	for _, variable := range unitEnvironment {
+		value := os.Getenv(variable.name)
+		if value == "" {
+			continue
+		}
+		if variable.isPath {
+			absValue, err := filepath.Abs(value)
+			if err != nil {
+				return nil, err
+			}
+			value = absValue
+		}
+		unit.Environment = append(unit.Environment, systemdQuote(variable.name+"="+value))
+	}
+
+	// Secrets aren't written to the unit, which other users may be able
+	// to read.
+	secrets := []string{"ORCHARD_API_TOKEN", "ORCHARD_TOKEN_PASSPHRASE"}
+	if profile, err := authenticator.CurrentProfile(); err == nil && profile.TokenEnv != "" {
+		secrets = append(secrets, profile.TokenEnv)
+	}
+	for _, name := range secrets {
+		if os.Getenv(name) != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s isn't written to the unit, so the proxy won't use it. Set ORCHARD_API_TOKEN_FILE to a file holding the token instead.\n", name)
+		}
+	}
+
+	// The unit mustn't depend on how this process would pick a token
+	// store, and it can't be asked for the encrypted file's passphrase.
+	storeName, err := authenticator.TokenStoreName()
+	if err == authenticator.ErrNoTokenStore && os.Getenv("ORCHARD_API_TOKEN_FILE") != "" {
+		// The proxy doesn't need one.
+		return unit, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if storeName == authenticator.EncryptedFileStoreName && os.Getenv("ORCHARD_API_TOKEN_FILE") == "" {
+		return nil, fmt.Errorf("Proxies run by systemd can't ask for the passphrase for API tokens saved in the encrypted file. Use another token store (see 'orchard login -h'), or set ORCHARD_API_TOKEN_FILE to a file holding a token.")
+	}
+	unit.Environment = append(unit.Environment, systemdQuote("ORCHARD_TOKEN_STORE="+storeName))
+
+	return unit, nil
+}
+
+// Returns the URL to set DOCKER_HOST to, with $XDG_RUNTIME_DIR standing in
+// for systemd's %t.
+func (unit *ProxyUnit) DockerHost() string {
+	if strings.HasPrefix(unit.ListenStream, "%t/") {
+		return "unix://$XDG_RUNTIME_DIR/" + strings.TrimPrefix(unit.ListenStream, "%t/")
+	}
+	if unit.SocketPath != "" {
+		return "unix://" + unit.SocketPath
+	}
+	return "tcp://" + unit.ListenStream
+}
+
+// Writes the .socket and .service units to dir, returning their paths.
+func (unit *ProxyUnit) Write(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, t := range []*template.Template{socketUnitTemplate, serviceUnitTemplate} {
+		var b strings.Builder
+		if err := t.Execute(&b, unit); err != nil {
+			return nil, err
+		}
+		unitPath := path.Join(dir, unit.Name+"."+t.Name())
+		if err := ioutil.WriteFile(unitPath, []byte(b.String()), 0644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, unitPath)
+	}
+	return paths, nil
+}
+
+// Quotes a word for a systemd unit file if it needs it.
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\%$;") {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "%", "%%", -1)
+	s = strings.Replace(s, "$", "$$", -1)
+	return `"` + s + `"`
+}
+
+// Returns the directory systemd reads the user's units from.
+func systemdUserDir() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = path.Join(os.Getenv("HOME"), ".config")
+	}
+	return path.Join(configDir, "systemd", "user")
+}
+
+func RunInstallUnit(ctx context.Context, cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError("`orchard proxy install-unit` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	if *flInstallUnitIdleTimeout < 0 {
+		return cmd.UsageError("--idle-timeout can't be negative, but got %s", *flInstallUnitIdleTimeout)
+	}
+	if listen := *flInstallUnitListen; listen != "" && !strings.HasPrefix(listen, "/") {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return cmd.UsageError("--listen must be an absolute path or a TCP address, but got %q", listen)
+		}
+	}
+
+	hostName := *flInstallUnitHost
+	if hostName == "" {
+		hostName = authenticator.DefaultHostName()
+	}
+
+	// Fetching the host first means any prompting for credentials happens
+	// now rather than when the proxy is first started.
+	if _, err := GetHost(ctx, hostName); err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	unit, err := NewProxyUnit(hostName, *flInstallUnitListen, *flInstallUnitIdleTimeout, executable)
+	if err != nil {
+		return err
+	}
+
+	dir := *flInstallUnitDir
+	if dir == "" {
+		dir = systemdUserDir()
+	}
+	paths, err := unit.Write(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, unitPath := range paths {
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", unitPath)
+	}
+	fmt.Fprintf(os.Stderr, `To start listening, run:
+systemctl --user daemon-reload
+systemctl --user enable --now %s.socket
+Then use the proxy by setting your Docker host:
+export DOCKER_HOST=%s
+`, unit.Name, unit.DockerHost())
+	return nil
+}
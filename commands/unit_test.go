@@ -0,0 +1,53 @@
+package commands
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProxyUnitEnvironment(t *testing.T) {
+	_, cleanup := withTempHome(t)
+	defer cleanup()
+
+	values := map[string]string{
+		"ORCHARD_API_URL":          "https://api.example.com/v2",
+		"ORCHARD_HOST_CA":          "/etc/orchard/ca.pem",
+		"ORCHARD_API_TOKEN_FILE":   "token",
+		"ORCHARD_USERNAME":         "",
+		"ORCHARD_PASSWORD_FILE":    "",
+		"ORCHARD_API_TOKEN":        "secret",
+		"ORCHARD_TOKEN_PASSPHRASE": "",
+		"ORCHARD_TOKEN_STORE":      "file",
+	}
+	for name, value := range values {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	unit, err := NewProxyUnit("web", "", 0, "/usr/bin/orchard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths are made absolute, as the proxy doesn't run in this directory,
+	// and the token itself isn't written.
+	expected := []string{
+		"ORCHARD_API_URL=https://api.example.com/v2",
+		"ORCHARD_API_TOKEN_FILE=" + wd + "/token",
+		"ORCHARD_HOST_CA=/etc/orchard/ca.pem",
+	}
+	environment := unit.Environment
+	if len(environment) != len(expected)+1 || !strings.HasPrefix(environment[len(expected)], "ORCHARD_TOKEN_STORE=") {
+		t.Fatalf("expected the forwarded settings and the token store, got %v", environment)
+	}
+	for i, value := range expected {
+		if environment[i] != value {
+			t.Errorf("expected %s, got %s", value, environment[i])
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Package docker is a small client for the Docker Remote API, covering
+// what the orchard command needs without a local docker binary.
+package docker
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client makes Docker Remote API requests over connections from its
+// HTTPClient.
+type Client struct {
+	HTTPClient *http.Client
+
+	// BaseURL is prepended to request paths. Its host is only used to
+	// pick a connection if HTTPClient's transport dials by host name.
+	BaseURL string
+}
+
+// NewClient returns a client that makes requests over connections from
+// dial, such as ones to an Orchard host's Docker daemon.
+func NewClient(dial func(ctx context.Context) (net.Conn, error)) *Client {
+	return &Client{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dial(ctx)
+				},
+			},
+		},
+		BaseURL: "http://docker",
+	}
+}
+
+// Port is a port exposed by a container.
+type Port struct {
+	IP          string `json:",omitempty"`
+	PrivatePort int
+	PublicPort  int `json:",omitempty"`
+	Type        string
+}
+
+func (p Port) String() string {
+	if p.PublicPort == 0 {
+		return fmt.Sprintf("%d/%s", p.PrivatePort, p.Type)
+	}
+	return fmt.Sprintf("%s:%d->%d/%s", p.IP, p.PublicPort, p.PrivatePort, p.Type)
+}
+
+// Container is a container as listed by /containers/json.
+type Container struct {
+	ID      string `json:"Id"`
+	Names   []string
+	Image   string
+	Command string
+	Created int64
+	Status  string
+	Ports   []Port
+}
+
+// Name returns the container's name, without the leading slash.
+func (c *Container) Name() string {
+	for _, name := range c.Names {
+		// Links are listed as names too, e.g. /web/db.
+		if strings.Count(name, "/") == 1 {
+			return strings.TrimPrefix(name, "/")
+		}
+	}
+	return ""
+}
+
+// ContainerDetails is the part of /containers/ID/json the client uses.
+type ContainerDetails struct {
+	ID     string `json:"Id"`
+	Name   string
+	Config struct {
+		Tty bool
+	}
+	State struct {
+		Running bool
+	}
+}
+
+// Image is an image as listed by /images/json.
+type Image struct {
+	ID          string `json:"Id"`
+	RepoTags    []string
+	Created     int64
+	Size        int64
+	VirtualSize int64
+}
+
+// Info is the part of /info the client uses.
+type Info struct {
+	Containers      int
+	Images          int
+	Driver          string
+	ExecutionDriver string
+	KernelVersion   string
+	OperatingSystem string `json:",omitempty"`
+	NCPU            int    `json:",omitempty"`
+	MemTotal        int64  `json:",omitempty"`
+	Name            string `json:",omitempty"`
+	ServerVersion   string `json:",omitempty"`
+}
+
+// Error is an error response from the Docker daemon.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// IsNotFound reports whether err is a 404 response, such as for a
+// container that doesn't exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Makes a request, returning the response if its status is 2xx or 304.
+// The caller must close the response's body.
+func (client *Client) do(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := client.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// The request's URL is meaningless to users.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("Error connecting to the Docker daemon: %s", err)
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+		return nil, newError(resp)
+	}
+	return resp, nil
+}
+
+// Older daemons respond with plain text errors, and newer ones with JSON.
+func newError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	message := strings.TrimSpace(string(body))
+	var jsonError struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &jsonError) == nil && jsonError.Message != "" {
+		message = jsonError.Message
+	}
+	if message == "" {
+		message = resp.Status
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: message}
+}
+
+func (client *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := client.do(ctx, "GET", path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ListContainers lists running containers, or all of them if all is set.
+func (client *Client) ListContainers(ctx context.Context, all bool) ([]*Container, error) {
+	query := url.Values{}
+	if all {
+		query.Set("all", "1")
+	}
+	containers := []*Container{}
+	if err := client.get(ctx, "/containers/json", query, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// InspectContainer returns details of a container, by name or ID.
+func (client *Client) InspectContainer(ctx context.Context, id string) (*ContainerDetails, error) {
+	var details ContainerDetails
+	if err := client.get(ctx, "/containers/"+url.PathEscape(id)+"/json", nil, &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// ListImages lists top-level images.
+func (client *Client) ListImages(ctx context.Context) ([]*Image, error) {
+	images := []*Image{}
+	if err := client.get(ctx, "/images/json", nil, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Info returns system-wide information about the Docker daemon.
+func (client *Client) Info(ctx context.Context) (*Info, error) {
+	var info Info
+	if err := client.get(ctx, "/info", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// StopContainer stops a container, killing it if it hasn't exited after
+// timeout seconds. Stopping a container that isn't running succeeds.
+func (client *Client) StopContainer(ctx context.Context, id string, timeout int) error {
+	query := url.Values{"t": {strconv.Itoa(timeout)}}
+	resp, err := client.do(ctx, "POST", "/containers/"+url.PathEscape(id)+"/stop", query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// LogsOptions selects a container's logs.
+type LogsOptions struct {
+	Follow     bool
+	Timestamps bool
+
+	// Tail is the number of lines to show from the end of the logs, or
+	// "all".
+	Tail string
+}
+
+// Logs copies a container's output to stdout and stderr. With Follow
+// set, it keeps copying until the container exits or ctx is done.
+func (client *Client) Logs(ctx context.Context, id string, opts LogsOptions, stdout, stderr io.Writer) error {
+	details, err := client.InspectContainer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"stdout": {"1"}, "stderr": {"1"}}
+	if opts.Follow {
+		query.Set("follow", "1")
+	}
+	if opts.Timestamps {
+		query.Set("timestamps", "1")
+	}
+	if opts.Tail != "" {
+		query.Set("tail", opts.Tail)
+	}
+
+	resp, err := client.do(ctx, "GET", "/containers/"+url.PathEscape(id)+"/logs", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A container with a TTY has a single, raw output stream.
+	if details.Config.Tty {
+		_, err = io.Copy(stdout, resp.Body)
+	} else {
+		err = Demultiplex(stdout, stderr, resp.Body)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Demultiplex copies a stream of Docker's multiplexed stdout and stderr
+// frames to stdout and stderr, until it ends.
+func Demultiplex(stdout, stderr io.Writer, r io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var w io.Writer
+		switch header[0] {
+		case 0, 1:
+			w = stdout
+		case 2:
+			w = stderr
+		default:
+			return fmt.Errorf("Unexpected stream %d in Docker's output", header[0])
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Returns a client whose connections go to ts, however it's addressed.
+func testClient(ts *httptest.Server) *Client {
+	return NewClient(func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", ts.Listener.Addr().String())
+	})
+}
+
+func frame(stream byte, data string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func TestListContainers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" || r.URL.Query().Get("all") != "1" {
+			t.Errorf("unexpected request to %s", r.URL)
+		}
+		fmt.Fprintln(w, `[{"Id": "8dfafdbc3a40", "Names": ["/web/db", "/db"], "Image": "postgres", "Ports": [{"PrivatePort": 5432, "Type": "tcp"}]}]`)
+	}))
+	defer ts.Close()
+
+	containers, err := testClient(ts).ListContainers(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container, got %d", len(containers))
+	}
+	if name := containers[0].Name(); name != "db" {
+		t.Errorf("expected name db, got %q", name)
+	}
+	if port := containers[0].Ports[0].String(); port != "5432/tcp" {
+		t.Errorf("expected port 5432/tcp, got %q", port)
+	}
+}
+
+func TestLogsDemultiplexesOutput(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/db/json":
+			fmt.Fprintln(w, `{"Id": "8dfafdbc3a40", "Config": {"Tty": false}}`)
+		case "/containers/db/logs":
+			if r.URL.Query().Get("tail") != "10" {
+				t.Errorf("expected tail=10, got %s", r.URL.RawQuery)
+			}
+			w.Write(frame(1, "out\n"))
+			w.Write(frame(2, "err\n"))
+			w.Write(frame(1, "more\n"))
+		default:
+			t.Errorf("unexpected request to %s", r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	var stdout, stderr bytes.Buffer
+	err := testClient(ts).Logs(context.Background(), "db", LogsOptions{Tail: "10"}, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\nmore\n" {
+		t.Errorf("unexpected stdout %q", stdout.String())
+	}
+	if stderr.String() != "err\n" {
+		t.Errorf("unexpected stderr %q", stderr.String())
+	}
+}
+
+func TestStopContainer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Query().Get("t") != "5" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		switch r.URL.Path {
+		case "/containers/running/stop":
+			w.WriteHeader(http.StatusNoContent)
+		case "/containers/stopped/stop":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			http.Error(w, "No such container: missing", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	client := testClient(ts)
+
+	for _, id := range []string{"running", "stopped"} {
+		if err := client.StopContainer(context.Background(), id, 5); err != nil {
+			t.Errorf("expected %s to stop, got %v", id, err)
+		}
+	}
+
+	err := client.StopContainer(context.Background(), "missing", 5)
+	if !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if err != nil && err.Error() != "No such container: missing" {
+		t.Errorf("unexpected error message %q", err.Error())
+	}
+}
+
+func TestJSONError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, `{"message": "daemon is broken"}`)
+	}))
+	defer ts.Close()
+
+	_, err := testClient(ts).Info(context.Background())
+	if err == nil || err.Error() != "daemon is broken" {
+		t.Errorf("expected the daemon's message, got %v", err)
+	}
+}
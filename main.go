@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/authenticator"
 	"github.com/orchardup/go-orchard/commands"
 	"github.com/orchardup/go-orchard/constants"
 	"io"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"text/template"
 )
 
+var flTimeout = flag.Duration("timeout", api.DefaultTimeout, "")
+var flRetries = flag.Int("retries", api.DefaultRetryPolicy.MaxRetries, "")
+var flProfile = flag.String("profile", "", "")
+
 func main() {
 	if len(os.Args) > 1 && os.Args[1] == "--version" {
 		fmt.Printf("Orchard %s\n", constants.Version)
@@ -25,12 +33,27 @@ func main() {
 		usage()
 	}
 
+	api.DefaultTimeout = *flTimeout
+	api.DefaultRetryPolicy.MaxRetries = *flRetries
+	ctx := interruptContext()
+
+	// 'orchard profile' still works if the selected profile doesn't
+	// exist, so that it can be added or another one used.
+	if err := authenticator.SelectProfile(*flProfile); err != nil && args[0] != commands.Profile.Name() {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	for _, cmd := range commands.All {
 		if cmd.Name() == args[0] {
 			cmd.Flag.Usage = func() { cmd.Usage() }
 			cmd.Flag.Parse(args[1:])
 			args = cmd.Flag.Args()
-			err := cmd.Run(cmd, args)
+			err := cmd.Run(ctx, cmd, args)
+			if exitErr, ok := err.(*commands.ExitError); ok {
+				// A child process failed, and has said why.
+				os.Exit(exitErr.Code)
+			}
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
@@ -43,9 +66,31 @@ func main() {
 	usage()
 }
 
+// Returns a context that is canceled on the first SIGINT or SIGTERM.
+// Any further signal gets the default behaviour, so a second Ctrl-C
+// still kills a process that is stuck.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		signal.Stop(c)
+		cancel()
+	}()
+
+	return ctx
+}
+
 var usageTemplate = `Orchard command-line client.
 
-Usage: orchard COMMAND [ARG...]
+Usage: orchard [OPTIONS] COMMAND [ARG...]
+
+Options:
+  --timeout DURATION   Time limit for each Orchard API request (default 30s)
+  --retries N          Times to retry a failed API request that is safe to repeat (default 3)
+  --profile NAME       Profile to use instead of the current one (see 'orchard profile')
 
 Commands:
 {{range .}}
@@ -55,8 +100,7 @@ Run 'orchard COMMAND -h' for more information on a command.
 `
 
 func tmpl(w io.Writer, text string, data interface{}) {
-	t := template.New("top")
-	t.Funcs(template.FuncMap{"trim": strings.TrimSpace})
+	t := commands.NewTemplate("top")
 	template.Must(t.Parse(text))
 	if err := t.Execute(w, data); err != nil {
 		panic(err)
@@ -0,0 +1,216 @@
+// Package orchard connects programs to the Docker daemons on Orchard hosts
+// in-process, without running the orchard command.
+//
+// Credentials come from ORCHARD_API_TOKEN or ORCHARD_API_TOKEN_FILE, or
+// the token saved by 'orchard' when you log in. Nothing here ever prompts
+// or writes to the terminal: a token saved in an encrypted file is only
+// read if its passphrase is in ORCHARD_TOKEN_PASSPHRASE.
+//
+//	conn, err := orchard.Dial(ctx, "default")
+//
+// Docker client libraries can use a Client's Transport, with hosts
+// addressed by name:
+//
+//	client, err := orchard.NewClientFromEnvironment()
+//	httpClient := &http.Client{Transport: client.Transport()}
+//	resp, err := httpClient.Get("http://default/containers/json")
+package orchard
+
+import (
+	"context"
+	"errors"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"github.com/orchardup/go-orchard/vendor/crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNoCredentials is returned by NewClientFromEnvironment if there's no
+// API token to use.
+var ErrNoCredentials = errors.New("orchard: no API token found; set ORCHARD_API_TOKEN or ORCHARD_API_TOKEN_FILE, or run 'orchard login'")
+
+// The port hosts' Docker daemons listen on.
+var DockerPort = 4243
+
+// Client dials the Docker daemons of an Orchard account's hosts. Hosts'
+// addresses and certificates are fetched from the API the first time
+// they're dialed, and again if a dial fails.
+type Client struct {
+	API *api.HTTPClient
+
+	mu    sync.Mutex
+	hosts map[string]*api.Host
+}
+
+// NewClient returns a client for the API at apiURL, using the given API
+// token.
+func NewClient(apiURL, token string) *Client {
+	return &Client{API: api.NewHTTPClient(apiURL, token)}
+}
+
+// NewClientFromEnvironment returns a client for the API at
+// ORCHARD_API_URL, or the current profile's, or Orchard's own, using the
+// token in ORCHARD_API_TOKEN, ORCHARD_API_TOKEN_FILE or the profile's
+// token_env variable, or the one saved by the orchard command. It returns
+// ErrNoCredentials if there isn't one, or if it's saved in an encrypted
+// file and ORCHARD_TOKEN_PASSPHRASE isn't set.
+func NewClientFromEnvironment() (*Client, error) {
+	apiURL := authenticator.GetAPIURL()
+	token, err := authenticator.NonInteractiveToken(apiURL)
+	if err != nil && err != authenticator.ErrPassphraseRequired {
+		return nil, err
+	}
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	return NewClient(apiURL, token), nil
+}
+
+// Host returns the host with the given name, or the default host if name
+// is empty: the current profile's default_host, or "default".
+func (c *Client) Host(ctx context.Context, name string) (*api.Host, error) {
+	if name == "" {
+		name = authenticator.DefaultHostName()
+	}
+
+	c.mu.Lock()
+	host, ok := c.hosts[name]
+	c.mu.Unlock()
+	if ok {
+		return host, nil
+	}
+
+	host, err := c.API.GetHostContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]*api.Host)
+	}
+	c.hosts[name] = host
+	return host, nil
+}
+
+// Dial connects to the Docker daemon on the host with the given name, or
+// the default host if name is empty.
+func (c *Client) Dial(ctx context.Context, hostName string) (net.Conn, error) {
+	host, err := c.Host(ctx, hostName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := DialHost(ctx, host)
+	if err != nil {
+		// The host may have been recreated with a new address.
+		c.mu.Lock()
+		if c.hosts[host.Name] == host {
+			delete(c.hosts, host.Name)
+		}
+		c.mu.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialContext connects to the Docker daemon on the host named by addr's
+// host part, ignoring the network and port. It can be used as an
+// http.Transport's DialContext, so that a request to http://NAME/...
+// goes to host NAME.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	hostName, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		hostName = addr
+	}
+	return c.Dial(ctx, hostName)
+}
+
+// Transport returns an http.RoundTripper that sends plain HTTP requests
+// to the Docker daemon on the host named in each request's URL.
+func (c *Client) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:         c.DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+var defaultClient struct {
+	sync.Mutex
+	client *Client
+}
+
+// Dial connects to the Docker daemon on the host with the given name, or
+// the default host if name is empty, using a shared client created with
+// NewClientFromEnvironment. If creating it fails, the next call tries
+// again, so that logging in or setting a token takes effect.
+func Dial(ctx context.Context, hostName string) (net.Conn, error) {
+	defaultClient.Lock()
+	if defaultClient.client == nil {
+		client, err := NewClientFromEnvironment()
+		if err != nil {
+			defaultClient.Unlock()
+			return nil, err
+		}
+		defaultClient.client = client
+	}
+	client := defaultClient.client
+	defaultClient.Unlock()
+
+	return client.Dial(ctx, hostName)
+}
+
+// DockerAddress returns the address of a host's Docker daemon.
+func DockerAddress(host *api.Host) string {
+	return net.JoinHostPort(host.IPAddress, strconv.Itoa(DockerPort))
+}
+
+// DialHost connects to a host's Docker daemon over TLS, authenticating
+// with the host's client certificate. The daemon is verified against the
+// current profile's host_ca, if it has one.
+func DialHost(ctx context.Context, host *api.Host) (net.Conn, error) {
+	config, err := tlsconfig.GetTLSConfig([]byte(host.ClientCert), []byte(host.ClientKey), authenticator.HostCAFile())
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = host.IPAddress
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", DockerAddress(host))
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is abandoned if ctx is done before it finishes.
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
+	close(stop)
+	<-stopped
+
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
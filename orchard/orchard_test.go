@@ -0,0 +1,226 @@
+package orchard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"github.com/orchardup/go-orchard/authenticator"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"github.com/orchardup/go-orchard/vendor/crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Starts a TLS server standing in for a host's Docker daemon, and an API
+// that knows about it as the host "web". Returns the API's URL and a
+// function that stops them.
+func startHost(t *testing.T) (string, func()) {
+	caCert, caKey, err := tlsconfig.GenerateCA("Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey, err := tlsconfig.GenerateCertificate(caCert, caKey, "Test Docker", []string{"127.0.0.1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey, err := tlsconfig.GenerateCertificate(caCert, caKey, "Test Client", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "orchard-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := path.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("ORCHARD_HOST_CA", caFile)
+
+	cert, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+
+	oldPort := DockerPort
+	DockerPort = listener.Addr().(*net.TCPAddr).Port
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosts/web" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"name":         "web",
+			"ipv4_address": "127.0.0.1",
+			"client_cert":  string(clientCert),
+			"client_key":   string(clientKey),
+		})
+	}))
+	return ts.URL, func() {
+		ts.Close()
+		listener.Close()
+		DockerPort = oldPort
+		os.Unsetenv("ORCHARD_HOST_CA")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	apiURL, stop := startHost(t)
+	defer stop()
+	client := NewClient(apiURL, "token")
+	httpClient := &http.Client{Transport: client.Transport()}
+
+	resp, err := httpClient.Get("http://web/_ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "OK" {
+		t.Errorf("expected OK, got %q", body)
+	}
+}
+
+func TestDialUnknownHost(t *testing.T) {
+	apiURL, stop := startHost(t)
+	defer stop()
+	client := NewClient(apiURL, "token")
+
+	_, err := client.Dial(context.Background(), "db")
+	if !api.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	apiURL, stop := startHost(t)
+	defer stop()
+	client := NewClient(apiURL, "token")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Dial(ctx, "web"); err == nil {
+		t.Error("expected an error dialing with a canceled context")
+	}
+}
+
+func TestNewClientFromEnvironmentWithoutCredentials(t *testing.T) {
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("ORCHARD_API_TOKEN", os.Getenv("ORCHARD_API_TOKEN"))
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_API_TOKEN", "")
+
+	if _, err := NewClientFromEnvironment(); err != ErrNoCredentials {
+		t.Errorf("expected ErrNoCredentials, got %v", err)
+	}
+
+	os.Setenv("ORCHARD_API_TOKEN", "secret")
+	client, err := NewClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.API.Token != "secret" {
+		t.Errorf("expected token from ORCHARD_API_TOKEN, got %q", client.API.Token)
+	}
+	if !strings.HasPrefix(client.API.BaseURL, "http") {
+		t.Errorf("unexpected API URL %q", client.API.BaseURL)
+	}
+}
+
+func TestDialUsesProfileHostCA(t *testing.T) {
+	apiURL, stop := startHost(t)
+	defer stop()
+	caFile := os.Getenv("ORCHARD_HOST_CA")
+	os.Setenv("ORCHARD_HOST_CA", "")
+
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("ORCHARD_PROFILE", os.Getenv("ORCHARD_PROFILE"))
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_PROFILE", "")
+	defer authenticator.SelectProfile("")
+
+	config := &authenticator.Config{
+		Current: "test",
+		Profiles: map[string]*authenticator.Profile{
+			"test":  {HostCA: caFile},
+			"other": {},
+		},
+	}
+	if err := config.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(apiURL, "token")
+	if err := authenticator.SelectProfile("test"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("expected the host to be verified with the profile's host_ca, got %v", err)
+	}
+	conn.Close()
+
+	// Another profile doesn't inherit it.
+	if err := authenticator.SelectProfile("other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Dial(context.Background(), "web"); err == nil {
+		t.Error("expected the host not to be verified against Orchard's CA")
+	}
+}
+
+func TestDialRetriesAfterNoCredentials(t *testing.T) {
+	apiURL, stop := startHost(t)
+	defer stop()
+	home, err := ioutil.TempDir("", "orchard-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, name := range []string{"HOME", "ORCHARD_API_URL", "ORCHARD_API_TOKEN"} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("ORCHARD_API_URL", apiURL)
+	os.Setenv("ORCHARD_API_TOKEN", "")
+	defer func() { defaultClient.client = nil }()
+
+	if _, err := Dial(context.Background(), "web"); err != ErrNoCredentials {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+
+	// The error isn't remembered once there's a token.
+	os.Setenv("ORCHARD_API_TOKEN", "token")
+	conn, err := Dial(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
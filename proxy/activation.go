@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// ActivationListeners returns the listeners passed to this process by
+// systemd socket activation, as described in sd_listen_fds(3). The
+// LISTEN_* environment variables are unset so that child processes don't
+// also try to use them.
+func ActivationListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	listeners := []net.Listener{}
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("File descriptor %d passed by socket activation isn't a listening socket: %s", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// ActivationListener returns the single listener passed by socket
+// activation, for use as a proxy's ListenFunc.
+func ActivationListener() (net.Listener, error) {
+	listeners, err := ActivationListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) != 1 {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("Expected 1 socket from socket activation, but got %d", len(listeners))
+	}
+	return listeners[0], nil
+}
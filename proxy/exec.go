@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ExecDialer opens streams to a command run in a container with the
+// Docker Remote API's exec endpoints, so that a proxy can forward
+// connections to it. The command's stdin and stdout become the stream.
+type ExecDialer struct {
+	// DialFunc connects to the Docker daemon.
+	DialFunc func() (net.Conn, error)
+
+	Container string
+	Cmd       []string
+
+	// Stderr receives anything the command writes to stderr.
+	Stderr io.Writer
+}
+
+// ForwardPortCmd returns a command that connects its stdin and stdout to
+// a TCP port inside the container, with whichever of nc or socat it has.
+func ForwardPortCmd(port int) []string {
+	script := fmt.Sprintf(`if command -v nc >/dev/null 2>&1; then exec nc 127.0.0.1 %d
+elif command -v socat >/dev/null 2>&1; then exec socat - TCP:127.0.0.1:%d
+else echo "Forwarding needs nc or socat to be installed in the container" >&2; exit 127
+fi`, port, port)
+	return []string{"sh", "-c", script}
+}
+
+// CheckContainer returns an error if the container isn't running.
+func (d *ExecDialer) CheckContainer() error {
+	var container struct {
+		State struct {
+			Running bool
+		}
+	}
+	if err := d.request("GET", "/containers/"+url.QueryEscape(d.Container)+"/json", nil, &container); err != nil {
+		return err
+	}
+	if !container.State.Running {
+		return fmt.Errorf("Container %s is not running", d.Container)
+	}
+	return nil
+}
+
+// Dial starts the command in the container and returns a connection to
+// its stdin and stdout.
+func (d *ExecDialer) Dial() (net.Conn, error) {
+	execConfig := map[string]interface{}{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          false,
+		"Cmd":          d.Cmd,
+	}
+	var created struct {
+		Id string
+	}
+	if err := d.request("POST", "/containers/"+url.QueryEscape(d.Container)+"/exec", execConfig, &created); err != nil {
+		return nil, err
+	}
+
+	conn, err := d.DialFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(map[string]bool{"Detach": false, "Tty": false})
+	req, err := http.NewRequest("POST", "http://docker/exec/"+created.Id+"/start", bytes.NewReader(body))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		return nil, dockerError(resp)
+	}
+
+	stderr := d.Stderr
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	return &execConn{Conn: conn, reader: reader, stderr: stderr}, nil
+}
+
+// Makes a regular Docker Remote API request, decoding the JSON response
+// into v.
+func (d *ExecDialer) request(method, path string, body interface{}, v interface{}) error {
+	conn, err := d.DialFunc()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var bodyReader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://docker"+path, bodyReader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Close = true
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return dockerError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Returns the message from a Docker error response, which is JSON in
+// newer API versions and plain text in older ones.
+func dockerError(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil && body.Message != "" {
+		message = body.Message
+	}
+	if message == "" {
+		message = resp.Status
+	}
+	return fmt.Errorf("Docker returned an error: %s", message)
+}
+
+// A connection to an exec'd command. Output is multiplexed by the daemon
+// into frames, each with an 8-byte header giving the stream (1 for
+// stdout, 2 for stderr) and the length of the frame.
+type execConn struct {
+	net.Conn
+	reader *bufio.Reader
+	stderr io.Writer
+
+	mu        sync.Mutex
+	remaining int
+}
+
+func (c *execConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.remaining == 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint32(header[4:]))
+		if header[0] == 2 {
+			if _, err := io.CopyN(c.stderr, c.reader, int64(size)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		c.remaining = size
+	}
+
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.remaining -= n
+	return n, err
+}
+
+func (c *execConn) CloseWrite() error {
+	CloseWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Serves just enough of the Docker Remote API to exec a command that
+// echoes its stdin back on stdout, after a greeting on stderr.
+func serveFakeExec(t *testing.T, listener net.Listener, stderr string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+
+			switch {
+			case req.URL.Path == "/containers/web/json":
+				fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 28\r\n\r\n{\"State\": {\"Running\": true}}")
+			case strings.HasPrefix(req.URL.Path, "/containers/") && strings.HasSuffix(req.URL.Path, "/exec"):
+				if !strings.HasPrefix(req.URL.Path, "/containers/web/") {
+					fmt.Fprint(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 40\r\n\r\n{\"message\": \"No such container: nope\"}\n\n")
+					return
+				}
+				var config struct {
+					Cmd []string
+				}
+				json.NewDecoder(req.Body).Decode(&config)
+				if len(config.Cmd) != 3 || config.Cmd[0] != "sh" {
+					t.Errorf("unexpected exec command: %v", config.Cmd)
+				}
+				fmt.Fprint(conn, "HTTP/1.1 201 Created\r\nContent-Type: application/json\r\nContent-Length: 13\r\n\r\n{\"Id\": \"123\"}")
+			case req.URL.Path == "/exec/123/start":
+				ioutil.ReadAll(req.Body)
+				fmt.Fprint(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+				writeFrame(conn, 2, []byte(stderr))
+				buf := make([]byte, 1024)
+				for {
+					n, err := reader.Read(buf)
+					if n > 0 {
+						writeFrame(conn, 1, buf[:n])
+					}
+					if err != nil {
+						return
+					}
+				}
+			default:
+				t.Errorf("unexpected request: %s %s", req.Method, req.URL.Path)
+			}
+		}()
+	}
+}
+
+func writeFrame(w io.Writer, stream byte, data []byte) {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	w.Write(header)
+	w.Write(data)
+}
+
+func TestExecDialerForwardsThroughProxy(t *testing.T) {
+	docker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+	go serveFakeExec(t, docker, "hello from stderr")
+
+	var stderr syncBuffer
+	dialer := &ExecDialer{
+		DialFunc:  func() (net.Conn, error) { return net.Dial("tcp", docker.Addr().String()) },
+		Container: "web",
+		Cmd:       ForwardPortCmd(5432),
+		Stderr:    &stderr,
+	}
+	if err := dialer.CheckContainer(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		dialer.Dial,
+	)
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "ping")
+	conn.(*net.TCPConn).CloseWrite()
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("expected %q, got %q", "ping", reply)
+	}
+	if stderr.String() != "hello from stderr" {
+		t.Errorf("expected stderr to be passed on, got %q", stderr.String())
+	}
+}
+
+func TestExecDialerError(t *testing.T) {
+	docker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+	go serveFakeExec(t, docker, "")
+
+	dialer := &ExecDialer{
+		DialFunc:  func() (net.Conn, error) { return net.Dial("tcp", docker.Addr().String()) },
+		Container: "nope",
+		Cmd:       ForwardPortCmd(80),
+	}
+	_, err = dialer.Dial()
+	if err == nil || !strings.Contains(err.Error(), "No such container: nope") {
+		t.Errorf("expected a no such container error, got %v", err)
+	}
+}
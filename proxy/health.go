@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Health states of a proxy's upstream Docker daemon.
+const (
+	HealthUnknown = "unknown"
+	HealthUp      = "up"
+	HealthDown    = "down"
+)
+
+// HealthStatus describes whether a proxy's upstream can be reached, as of
+// the last health check or dial.
+type HealthStatus struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	Error string    `json:"error,omitempty"`
+}
+
+// DefaultDialRetry is used by proxies created with New. Dials to an
+// upstream that failed its last health check aren't retried.
+var DefaultDialRetry = api.RetryPolicy{
+	MaxRetries: 3,
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+}
+
+// How long a health check waits for the upstream to respond.
+var HealthCheckTimeout = 10 * time.Second
+
+// Health returns the upstream's current health.
+func (p *Proxy) Health() HealthStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health
+}
+
+// Updates the upstream's health after a dial or health check, calling
+// OnHealthChange if its state has changed.
+func (p *Proxy) recordHealth(err error) {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+
+	state := HealthUp
+	message := ""
+	if err != nil {
+		state = HealthDown
+		message = err.Error()
+	}
+
+	p.mu.Lock()
+	changed := p.health.State != state
+	if changed {
+		p.health.Since = time.Now()
+	}
+	p.health.State = state
+	p.health.Error = message
+	status := p.health
+	p.mu.Unlock()
+
+	if changed && p.OnHealthChange != nil {
+		p.OnHealthChange(status)
+	}
+}
+
+// Dials the upstream, retrying failures with backoff unless the proxy is
+// shutting down or the upstream is known to be down.
+func (p *Proxy) dialUpstream(dialFunc func() (net.Conn, error)) (net.Conn, error) {
+	retry := p.DialRetry
+	if retry == nil || p.Health().State == HealthDown {
+		retry = &api.RetryPolicy{}
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		conn, err := dialFunc()
+		p.metrics.recordDial(time.Since(start), err)
+		if err == nil || attempt >= retry.MaxRetries || p.isClosing() {
+			return conn, err
+		}
+		time.Sleep(retry.Backoff(attempt))
+	}
+}
+
+// Runs health checks every interval until stop is closed.
+func (p *Proxy) checkHealth(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.recordHealth(p.Ping())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Ping checks that the upstream Docker daemon responds to /_ping.
+func (p *Proxy) Ping() error {
+	conn, err := dialTimeout(p.DialFunc, HealthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(HealthCheckTimeout))
+
+	req, err := http.NewRequest("GET", "http://docker/_ping", nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker responded to /_ping with %s", resp.Status)
+	}
+	return nil
+}
+
+// Calls dialFunc, giving up after timeout. A connection that's made after
+// that is closed.
+func dialTimeout(dialFunc func() (net.Conn, error), timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dialFunc()
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out connecting after %s", timeout)
+	}
+}
+
+// Responds to a client whose upstream couldn't be reached. Docker clients
+// get a Docker-style error; anything else that doesn't send an HTTP
+// request is just disconnected.
+func (p *Proxy) rejectConnection(clientConn net.Conn, err error) {
+	clientConn.SetReadDeadline(time.Now().Add(HealthCheckTimeout))
+	reader := bufio.NewReader(clientConn)
+	req, readErr := http.ReadRequest(reader)
+	if readErr != nil {
+		return
+	}
+	p.Logger.LogRequest(req, fmt.Sprintf("%d (%s)", http.StatusBadGateway, err), 0)
+	writeError(clientConn, req, http.StatusBadGateway, fmt.Sprintf("Error connecting to the host's Docker daemon: %s", err))
+
+	// Closing with unread data would reset the connection, possibly
+	// before the client has read the error.
+	CloseWrite(clientConn)
+	io.Copy(ioutil.Discard, reader)
+}
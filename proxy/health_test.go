@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/orchardup/go-orchard/api"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyRetriesDials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	dials := 0
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if dials++; dials < 3 {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial("tcp", ts.Listener.Addr().String())
+		},
+	)
+	p.DialRetry = &api.RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	// Raw connections aren't closed by Shutdown until they're finished.
+	req, _ := http.NewRequest("GET", "http://"+p.Listener.Addr().String()+"/_ping", nil)
+	req.Close = true
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	if health := p.Health(); health.State != HealthUp {
+		t.Errorf("expected upstream to be up, got %+v", health)
+	}
+}
+
+func TestProxyReportsUnreachableUpstream(t *testing.T) {
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) { return nil, errors.New("connection refused") },
+	)
+	p.DialRetry = &api.RetryPolicy{MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	resp, err := http.Post("http://"+p.Listener.Addr().String()+"/containers/create", "application/json", strings.NewReader(`{"Image": "ubuntu"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != 502 || !strings.Contains(body["message"], "connection refused") {
+		t.Errorf("expected a 502 with a Docker-style message, got %d %v", resp.StatusCode, body)
+	}
+	if health := p.Health(); health.State != HealthDown || health.Error != "connection refused" {
+		t.Errorf("expected upstream to be down, got %+v", health)
+	}
+}
+
+func TestProxyHealthCheck(t *testing.T) {
+	var mu sync.Mutex
+	healthy := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/_ping" {
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+		if !healthy {
+			w.WriteHeader(500)
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer ts.Close()
+
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) { return net.Dial("tcp", ts.Listener.Addr().String()) },
+	)
+	p.HealthCheckInterval = 10 * time.Millisecond
+	changes := make(chan HealthStatus, 10)
+	p.OnHealthChange = func(status HealthStatus) { changes <- status }
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	if status := <-changes; status.State != HealthUp {
+		t.Errorf("expected upstream to be up, got %+v", status)
+	}
+
+	mu.Lock()
+	healthy = false
+	mu.Unlock()
+
+	status := <-changes
+	if status.State != HealthDown || !strings.Contains(status.Error, "500") {
+		t.Errorf("expected upstream to be down, got %+v", status)
+	}
+}
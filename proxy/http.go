@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestLogger logs the Docker Remote API requests made through a proxy.
+type RequestLogger struct {
+	// LogBodies sets whether request and response bodies are logged, up
+	// to MaxBodySize bytes of each.
+	LogBodies   bool
+	MaxBodySize int
+
+	logger *log.Logger
+}
+
+func NewRequestLogger(w io.Writer, logBodies bool) *RequestLogger {
+	return &RequestLogger{
+		LogBodies:   logBodies,
+		MaxBodySize: 4096,
+		logger:      log.New(w, "", log.LstdFlags),
+	}
+}
+
+// The logging methods do nothing if the logger is nil.
+
+func (l *RequestLogger) LogRequest(req *http.Request, status string, latency time.Duration) {
+	if l == nil {
+		return
+	}
+	l.logger.Printf("%s %s %s %s", req.Method, req.URL.RequestURI(), status, latency)
+}
+
+func (l *RequestLogger) LogBody(req *http.Request, kind string, body *bodyCapture) {
+	if l == nil || body == nil || body.buf.Len() == 0 {
+		return
+	}
+	truncated := ""
+	if body.truncated {
+		truncated = " (truncated)"
+	}
+	l.logger.Printf("%s %s %s body%s: %s", req.Method, req.URL.RequestURI(), kind, truncated, body.buf.String())
+}
+
+// Keeps a copy of the first few bytes read from a body.
+type bodyCapture struct {
+	io.ReadCloser
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := c.max - c.buf.Len(); room > 0 {
+		if n > room {
+			c.buf.Write(p[:room])
+			c.truncated = true
+		} else {
+			c.buf.Write(p[:n])
+		}
+	} else if n > 0 {
+		c.truncated = true
+	}
+	return n, err
+}
+
+func (l *RequestLogger) Printf(format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.logger.Printf(format, args...)
+}
+
+func (l *RequestLogger) capture(body io.ReadCloser) *bodyCapture {
+	if l == nil || !l.LogBodies || body == nil || body == http.NoBody {
+		return nil
+	}
+	return &bodyCapture{ReadCloser: body, max: l.MaxBodySize}
+}
+
+// Reports whether the daemon has taken over the connection for a raw
+// stream, as it does for attach and exec.
+func isHijacked(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/vnd.docker.raw-stream") ||
+		strings.HasPrefix(contentType, "application/vnd.docker.multiplexed-stream")
+}
+
+// An upstream connection, with a reader for its responses.
+type upstreamConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Forwards HTTP requests from the client one at a time, parsing each
+// request and response so they can be logged and checked against the
+// policy. route picks where each request goes, rewriting it as it will be
+// forwarded, and returns a function that connects there. The policy
+// checks the rewritten request, so that it sees the path the daemon
+// will. Hijacked connections are forwarded as raw bytes once the
+// response headers have been sent.
+func (p *Proxy) forwardHTTP(clientConn net.Conn, route func(req *http.Request) (func() (*upstreamConn, error), error)) {
+	clientReader := bufio.NewReader(clientConn)
+	logger := p.Logger
+
+	for {
+		if !p.setIdle(clientConn, true) {
+			return
+		}
+		req, err := http.ReadRequest(clientReader)
+		p.setIdle(clientConn, false)
+		if err != nil {
+			if err != io.EOF && !p.isClosing() {
+				logger.Printf("error reading request: %s", err)
+			}
+			return
+		}
+
+		start := time.Now()
+
+		if p.AuthToken != "" {
+			if !p.authorized(req) {
+				logger.LogRequest(req, "401 (unauthorized)", time.Since(start))
+				writeError(clientConn, req, http.StatusUnauthorized, "This Orchard proxy requires an Authorization: Bearer token")
+				return
+			}
+			req.Header.Del("Authorization")
+		}
+
+		connect, err := route(req)
+		if err == nil && p.Policy != nil {
+			if reason := p.Policy.Check(req); reason != nil {
+				logger.LogRequest(req, fmt.Sprintf("403 (denied: %s)", reason), time.Since(start))
+				writeError(clientConn, req, http.StatusForbidden, fmt.Sprintf("Denied by Orchard proxy policy: %s", reason))
+				return
+			}
+		}
+
+		var server *upstreamConn
+		if err == nil {
+			server, err = connect()
+		}
+		if err != nil {
+			statusCode := http.StatusBadGateway
+			if routeErr, ok := err.(*RouteError); ok {
+				statusCode = routeErr.StatusCode
+			}
+			logger.LogRequest(req, fmt.Sprintf("%d (%s)", statusCode, err), time.Since(start))
+			writeError(clientConn, req, statusCode, err.Error())
+			return
+		}
+
+		reqBody := logger.capture(req.Body)
+		if reqBody != nil {
+			req.Body = reqBody
+		}
+
+		if err := req.Write(server); err != nil {
+			logger.LogRequest(req, fmt.Sprintf("error (%s)", err), time.Since(start))
+			return
+		}
+		logger.LogBody(req, "request", reqBody)
+
+		resp, err := http.ReadResponse(server.reader, req)
+		if err != nil {
+			logger.LogRequest(req, fmt.Sprintf("error (%s)", err), time.Since(start))
+			return
+		}
+
+		if isHijacked(resp) {
+			logger.LogRequest(req, fmt.Sprintf("%d (hijacked)", resp.StatusCode), time.Since(start))
+			if err := writeResponseHeader(clientConn, resp); err != nil {
+				return
+			}
+			pipe(clientConn, clientReader, server.Conn, server.reader)
+			return
+		}
+
+		logger.LogRequest(req, fmt.Sprintf("%d", resp.StatusCode), time.Since(start))
+
+		respBody := logger.capture(resp.Body)
+		if respBody != nil {
+			resp.Body = respBody
+		}
+		err = resp.Write(clientConn)
+		resp.Body.Close()
+		logger.LogBody(req, "response", respBody)
+
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// Reports whether the request carries the proxy's bearer token.
+func (p *Proxy) authorized(req *http.Request) bool {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.AuthToken)) == 1
+}
+
+// Writes a Docker-style JSON error response and closes the connection.
+func writeError(w io.Writer, req *http.Request, statusCode int, message string) error {
+	body, err := json.Marshal(map[string]string{"message": message})
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	resp := &http.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	return resp.Write(w)
+}
+
+func writeResponseHeader(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// Copies raw bytes in both directions, including anything already
+// buffered by the readers.
+func pipe(clientConn net.Conn, clientReader io.Reader, serverConn net.Conn, serverReader io.Reader) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(serverConn, clientReader)
+		CloseWrite(serverConn)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(clientConn, serverReader)
+		CloseWrite(clientConn)
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// A bytes.Buffer that's safe to write to from the proxy's goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newHTTPTestProxy(t *testing.T, upstreamAddr string, logger *RequestLogger) *Proxy {
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) { return net.Dial("tcp", upstreamAddr) },
+	)
+	p.Logger = logger
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	return p
+}
+
+func TestHTTPModeLogsRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/containers/create" {
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"Image":"ubuntu"}` {
+				t.Errorf("expected request body to be forwarded, got %q", body)
+			}
+			w.WriteHeader(201)
+			fmt.Fprint(w, `{"Id":"abc"}`)
+			return
+		}
+		w.WriteHeader(404)
+		fmt.Fprint(w, "no such container")
+	}))
+	defer ts.Close()
+
+	var out syncBuffer
+	p := newHTTPTestProxy(t, ts.Listener.Addr().String(), NewRequestLogger(&out, true))
+	defer p.Shutdown(context.Background())
+
+	baseURL := "http://" + p.Listener.Addr().String()
+
+	resp, err := http.Post(baseURL+"/containers/create", "application/json", strings.NewReader(`{"Image":"ubuntu"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 201 || string(body) != `{"Id":"abc"}` {
+		t.Errorf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(baseURL + "/containers/nope/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	p.Shutdown(context.Background())
+	log := out.String()
+
+	for _, expected := range []string{
+		"POST /containers/create 201",
+		`POST /containers/create request body: {"Image":"ubuntu"}`,
+		`POST /containers/create response body: {"Id":"abc"}`,
+		"GET /containers/nope/json 404",
+	} {
+		if !strings.Contains(log, expected) {
+			t.Errorf("expected log to contain %q, got:\n%s", expected, log)
+		}
+	}
+}
+
+func TestHTTPModeForwardsHijackedStreams(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+
+	// Behaves like the Docker daemon's attach endpoint: responds with
+	// headers, then echoes raw bytes.
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			fmt.Fprintln(conn, "echo: "+scanner.Text())
+		}
+	}()
+
+	var out syncBuffer
+	p := newHTTPTestProxy(t, upstream.Addr().String(), NewRequestLogger(&out, false))
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "POST /containers/abc/attach?stream=1&stdin=1 HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	fmt.Fprintln(conn, "hello")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "echo: hello\n" {
+		t.Errorf("expected 'echo: hello', got %q", line)
+	}
+
+	if log := out.String(); !strings.Contains(log, "POST /containers/abc/attach?stream=1&stdin=1 200 (hijacked)") {
+		t.Errorf("expected hijacked request to be logged, got:\n%s", log)
+	}
+}
+
+func TestHTTPModeRequiresAuthToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("expected the Authorization header to be removed, got %q", r.Header.Get("Authorization"))
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer ts.Close()
+
+	var dials int32
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial("tcp", ts.Listener.Addr().String())
+		},
+	)
+	p.AuthToken = "secret"
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	url := "http://" + p.Listener.Addr().String() + "/_ping"
+	for token, expected := range map[string]int{"": 401, "secret": 200, "wrong": 401} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		before := atomic.LoadInt32(&dials)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("token %q: expected %d, got %d", token, expected, resp.StatusCode)
+		}
+		if expected == 401 && atomic.LoadInt32(&dials) != before {
+			t.Errorf("token %q: expected the upstream not to be dialled for an unauthorized request", token)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds, in seconds, of the dial latency histogram's buckets.
+var DialLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics counts a proxy's connections and traffic since it was created.
+// Bytes sent are from clients to the upstream, and bytes received are
+// from the upstream to clients.
+type Metrics struct {
+	ActiveConnections int    `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	BytesSent         uint64 `json:"bytes_sent"`
+	BytesReceived     uint64 `json:"bytes_received"`
+	Dials             uint64 `json:"dials"`
+	DialFailures      uint64 `json:"dial_failures"`
+
+	// DialSeconds is the total time spent on successful dials, and
+	// DialBuckets counts them by latency, cumulatively, using the bounds
+	// in DialLatencyBuckets.
+	DialSeconds float64  `json:"dial_seconds"`
+	DialBuckets []uint64 `json:"dial_buckets"`
+}
+
+// The counters are updated atomically, apart from the dial latency
+// histogram, which is guarded by mu.
+type proxyMetrics struct {
+	totalConnections uint64
+	bytesSent        uint64
+	bytesReceived    uint64
+	dialFailures     uint64
+
+	mu          sync.Mutex
+	dials       uint64
+	dialSeconds float64
+	dialBuckets []uint64
+}
+
+func (m *proxyMetrics) recordDial(latency time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&m.dialFailures, 1)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dialBuckets == nil {
+		m.dialBuckets = make([]uint64, len(DialLatencyBuckets))
+	}
+	seconds := latency.Seconds()
+	m.dials++
+	m.dialSeconds += seconds
+	for i, bound := range DialLatencyBuckets {
+		if seconds <= bound {
+			m.dialBuckets[i]++
+		}
+	}
+}
+
+// Metrics returns a snapshot of the proxy's metrics.
+func (p *Proxy) Metrics() Metrics {
+	m := &p.metrics
+	metrics := Metrics{
+		ActiveConnections: p.ActiveConnections(),
+		TotalConnections:  atomic.LoadUint64(&m.totalConnections),
+		BytesSent:         atomic.LoadUint64(&m.bytesSent),
+		BytesReceived:     atomic.LoadUint64(&m.bytesReceived),
+		DialFailures:      atomic.LoadUint64(&m.dialFailures),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metrics.Dials = m.dials
+	metrics.DialSeconds = m.dialSeconds
+	metrics.DialBuckets = make([]uint64, len(DialLatencyBuckets))
+	copy(metrics.DialBuckets, m.dialBuckets)
+	return metrics
+}
+
+// A client connection that counts the bytes read from and written to it.
+type countingConn struct {
+	net.Conn
+	metrics *proxyMetrics
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.metrics.bytesSent, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.metrics.bytesReceived, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	CloseWrite(c.Conn)
+	return nil
+}
+
+// Completes the TLS handshake, if the connection uses TLS.
+func (c *countingConn) Handshake() error {
+	if tlsConn, ok := c.Conn.(interface {
+		Handshake() error
+	}); ok {
+		return tlsConn.Handshake()
+	}
+	return nil
+}
+
+// ProxyStatus is the state of a proxy reported by MetricsHandler.
+type ProxyStatus struct {
+	Host    string       `json:"host"`
+	Health  HealthStatus `json:"health"`
+	Metrics Metrics      `json:"metrics"`
+}
+
+// MetricsHandler serves the metrics of the proxies returned by proxies,
+// keyed by host name, in the Prometheus text format at /metrics, and as
+// JSON along with their health at /status.
+func MetricsHandler(proxies func() map[string]*Proxy) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w, proxyStatuses(proxies()))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body, err := json.MarshalIndent(map[string][]ProxyStatus{"proxies": proxyStatuses(proxies())}, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(append(body, '\n'))
+	})
+
+	return mux
+}
+
+func proxyStatuses(proxies map[string]*Proxy) []ProxyStatus {
+	hostNames := []string{}
+	for hostName := range proxies {
+		hostNames = append(hostNames, hostName)
+	}
+	sort.Strings(hostNames)
+
+	statuses := []ProxyStatus{}
+	for _, hostName := range hostNames {
+		p := proxies[hostName]
+		statuses = append(statuses, ProxyStatus{
+			Host:    hostName,
+			Health:  p.Health(),
+			Metrics: p.Metrics(),
+		})
+	}
+	return statuses
+}
+
+// WritePrometheus writes proxies' metrics in the Prometheus text format,
+// labelled by host.
+func WritePrometheus(w io.Writer, statuses []ProxyStatus) error {
+	type metric struct {
+		name, kind, help string
+		value            func(s ProxyStatus) float64
+	}
+	metrics := []metric{
+		{"orchard_proxy_up", "gauge", "Whether the host's Docker daemon passed its last health check, if it's been checked.", nil},
+		{"orchard_proxy_connections_active", "gauge", "Client connections being forwarded.",
+			func(s ProxyStatus) float64 { return float64(s.Metrics.ActiveConnections) }},
+		{"orchard_proxy_connections_total", "counter", "Client connections accepted.",
+			func(s ProxyStatus) float64 { return float64(s.Metrics.TotalConnections) }},
+		{"orchard_proxy_sent_bytes_total", "counter", "Bytes forwarded from clients to the host.",
+			func(s ProxyStatus) float64 { return float64(s.Metrics.BytesSent) }},
+		{"orchard_proxy_received_bytes_total", "counter", "Bytes forwarded from the host to clients.",
+			func(s ProxyStatus) float64 { return float64(s.Metrics.BytesReceived) }},
+		{"orchard_proxy_dial_failures_total", "counter", "Failed attempts to connect to the host.",
+			func(s ProxyStatus) float64 { return float64(s.Metrics.DialFailures) }},
+	}
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range statuses {
+			if m.value == nil {
+				if s.Health.State == HealthUnknown {
+					continue
+				}
+				up := 0
+				if s.Health.State == HealthUp {
+					up = 1
+				}
+				fmt.Fprintf(&b, "%s{host=%q} %d\n", m.name, s.Host, up)
+				continue
+			}
+			fmt.Fprintf(&b, "%s{host=%q} %s\n", m.name, s.Host, formatFloat(m.value(s)))
+		}
+	}
+
+	name := "orchard_proxy_dial_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time taken to connect to the host.\n# TYPE %s histogram\n", name, name)
+	for _, s := range statuses {
+		for i, bound := range DialLatencyBuckets {
+			fmt.Fprintf(&b, "%s_bucket{host=%q,le=%q} %d\n", name, s.Host, formatFloat(bound), s.Metrics.DialBuckets[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{host=%q,le=\"+Inf\"} %d\n", name, s.Host, s.Metrics.Dials)
+		fmt.Fprintf(&b, "%s_sum{host=%q} %s\n", name, s.Host, formatFloat(s.Metrics.DialSeconds))
+		fmt.Fprintf(&b, "%s_count{host=%q} %d\n", name, s.Host, s.Metrics.Dials)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
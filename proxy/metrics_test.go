@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	}))
+	defer ts.Close()
+
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) { return net.Dial("tcp", ts.Listener.Addr().String()) },
+	)
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://"+p.Listener.Addr().String()+"/_ping", nil)
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	p.Shutdown(context.Background())
+
+	metrics := p.Metrics()
+	if metrics.TotalConnections != 2 || metrics.ActiveConnections != 0 {
+		t.Errorf("expected 2 connections, none active, got %+v", metrics)
+	}
+	if metrics.Dials != 2 || metrics.DialFailures != 0 {
+		t.Errorf("expected 2 successful dials, got %+v", metrics)
+	}
+	if metrics.BytesSent == 0 || metrics.BytesReceived == 0 {
+		t.Errorf("expected bytes to be counted, got %+v", metrics)
+	}
+	if last := metrics.DialBuckets[len(metrics.DialBuckets)-1]; last != 2 {
+		t.Errorf("expected both dials in the last bucket, got %d", last)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	p := New(nil, func() (net.Conn, error) { return nil, errors.New("connection refused") })
+	p.DialRetry = nil
+	p.dialUpstream(p.DialFunc)
+	p.recordHealth(errors.New("connection refused"))
+
+	handler := MetricsHandler(func() map[string]*Proxy { return map[string]*Proxy{"web": p} })
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`orchard_proxy_up{host="web"} 0`,
+		`orchard_proxy_dial_failures_total{host="web"} 1`,
+		`orchard_proxy_dial_duration_seconds_count{host="web"} 0`,
+		`# TYPE orchard_proxy_connections_total counter`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%s", line, w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var status struct {
+		Proxies []ProxyStatus
+	}
+	if err := json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Proxies) != 1 || status.Proxies[0].Host != "web" || status.Proxies[0].Health.State != HealthDown {
+		t.Errorf("unexpected status: %s", w.Body.String())
+	}
+}
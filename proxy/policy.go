@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/orchardup/go-orchard/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Policy restricts the Docker Remote API requests a proxy will forward.
+// It's loaded from a YAML or JSON file, e.g.
+//
+//	deny_privileged: true
+//	deny_host_binds: true
+//	deny:
+//	  - method: DELETE
+//	    path: /containers
+//
+// Unknown keys are an error, so a mistyped rule can't silently allow
+// requests it was meant to deny.
+type Policy struct {
+	// ReadOnly denies everything but GET and HEAD requests.
+	ReadOnly bool `json:"read_only"`
+
+	// DenyPrivileged denies creating or starting containers that are
+	// privileged, add capabilities such as SYS_ADMIN, use host devices,
+	// disable confinement or share the host's namespaces, and running
+	// privileged exec commands.
+	DenyPrivileged bool `json:"deny_privileged"`
+
+	// DenyHostBinds denies creating or starting containers that
+	// bind-mount paths from the host, and creating volumes that do.
+	DenyHostBinds bool `json:"deny_host_binds"`
+
+	// Deny lists requests to deny by method and path.
+	Deny []PolicyRule `json:"deny"`
+}
+
+// PolicyRule matches requests by method (any, if empty) and path. The
+// path is matched against the request path with any API version prefix
+// removed, segment by segment, and matches any path it's a prefix of.
+// Segments can use wildcards, so "/containers/*/kill" matches
+// "/containers/abc/kill".
+type PolicyRule struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// The largest create or start request body that's checked.
+const maxPolicyBodySize = 1 << 20
+
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	if err := utils.UnmarshalStrictYAML(data, &policy); err != nil {
+		return nil, fmt.Errorf("Error reading policy %s: %s", filename, err)
+	}
+
+	for _, rule := range policy.Deny {
+		if rule.Path == "" || !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("Error reading policy %s: deny rule paths must start with '/', got %q", filename, rule.Path)
+		}
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return nil, fmt.Errorf("Error reading policy %s: invalid path %q", filename, rule.Path)
+		}
+	}
+
+	return &policy, nil
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// Strips the API version from a request path, e.g. "/v1.12/info" becomes
+// "/info".
+func apiPath(req *http.Request) string {
+	return versionPrefix.ReplaceAllString(req.URL.Path, "/")
+}
+
+func (rule PolicyRule) Matches(req *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, req.Method) {
+		return false
+	}
+
+	ruleParts := strings.Split(strings.Trim(rule.Path, "/"), "/")
+	pathParts := strings.Split(strings.Trim(apiPath(req), "/"), "/")
+	if len(ruleParts) > len(pathParts) {
+		return false
+	}
+	for i, rulePart := range ruleParts {
+		if matched, _ := path.Match(rulePart, pathParts[i]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns an error describing why the request is denied, or nil if
+// it's allowed. Bodies of container create and start, exec create and
+// volume create requests are read to check them, and replaced so they can
+// still be forwarded.
+func (policy *Policy) Check(req *http.Request) error {
+	if policy.ReadOnly && req.Method != "GET" && req.Method != "HEAD" {
+		return fmt.Errorf("the proxy is read-only, so %s requests are not allowed", req.Method)
+	}
+
+	for _, rule := range policy.Deny {
+		if rule.Matches(req) {
+			method := rule.Method
+			if method == "" {
+				method = "any"
+			}
+			return fmt.Errorf("%s requests to %s are not allowed", method, rule.Path)
+		}
+	}
+
+	if !policy.DenyPrivileged && !policy.DenyHostBinds {
+		return nil
+	}
+
+	kind := checkedRequestKind(req)
+	if kind == "" {
+		return nil
+	}
+	data, err := readCheckedBody(req)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return err
+	}
+
+	switch kind {
+	case "container":
+		configs, err := containerHostConfigs(data)
+		if err != nil {
+			return err
+		}
+		for _, config := range configs {
+			if policy.DenyPrivileged {
+				if privilege := config.privilege(); privilege != "" {
+					return fmt.Errorf("containers with %s are not allowed", privilege)
+				}
+			}
+			if policy.DenyHostBinds {
+				if bind := config.hostBind(); bind != "" {
+					return fmt.Errorf("bind-mounting %s from the host is not allowed", bind)
+				}
+			}
+		}
+
+	case "exec":
+		var exec struct{ Privileged bool }
+		if err := json.Unmarshal(data, &exec); err != nil {
+			return fmt.Errorf("the request body couldn't be checked: %s", err)
+		}
+		if policy.DenyPrivileged && exec.Privileged {
+			return fmt.Errorf("privileged exec commands are not allowed")
+		}
+
+	case "volume":
+		var volume struct{ DriverOpts map[string]string }
+		if err := json.Unmarshal(data, &volume); err != nil {
+			return fmt.Errorf("the request body couldn't be checked: %s", err)
+		}
+		if policy.DenyHostBinds {
+			if device := volumeDevice(volume.DriverOpts); device != "" {
+				return fmt.Errorf("volumes that mount %s from the host are not allowed", device)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns which kind of request body Check reads: "container" for
+// container create and start requests, "exec" for exec create requests,
+// "volume" for volume create requests, or "" for anything else.
+//
+// These are the requests that can give containers privileges or host
+// paths, but not the only ones: builds, plugins and services can too, and
+// should be denied with rules where that matters.
+func checkedRequestKind(req *http.Request) string {
+	if req.Method != "POST" || req.Body == nil {
+		return ""
+	}
+
+	parts := strings.Split(strings.Trim(apiPath(req), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "containers" && parts[1] == "create":
+		return "container"
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "start":
+		return "container"
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "exec":
+		return "exec"
+	case len(parts) == 2 && parts[0] == "volumes" && parts[1] == "create":
+		return "volume"
+	}
+	return ""
+}
+
+// Reads the request body, replacing it so it can still be forwarded.
+func readCheckedBody(req *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxPolicyBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPolicyBodySize {
+		return nil, fmt.Errorf("the request body is too large to check")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+type containerMount struct {
+	Type          string
+	Source        string
+	VolumeOptions struct {
+		DriverConfig struct {
+			Options map[string]string
+		}
+	}
+}
+
+type hostConfig struct {
+	Privileged  bool
+	Binds       []string
+	Mounts      []containerMount
+	CapAdd      []string
+	Devices     []json.RawMessage
+	SecurityOpt []string
+	PidMode     string
+	IpcMode     string
+	NetworkMode string
+	UTSMode     string
+	UsernsMode  string
+}
+
+// Capabilities that let a container take over its host.
+var hostCapabilities = map[string]bool{
+	"ALL":             true,
+	"SYS_ADMIN":       true,
+	"SYS_MODULE":      true,
+	"SYS_RAWIO":       true,
+	"SYS_PTRACE":      true,
+	"SYS_BOOT":        true,
+	"DAC_READ_SEARCH": true,
+	"MKNOD":           true,
+}
+
+// Describes the first way the container would be given privileges over
+// its host, or returns "" if it wouldn't.
+func (config *hostConfig) privilege() string {
+	if config.Privileged {
+		return "privileged mode"
+	}
+	for _, capability := range config.CapAdd {
+		name := strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+		if hostCapabilities[name] {
+			return "the " + name + " capability"
+		}
+	}
+	if len(config.Devices) > 0 {
+		return "host devices"
+	}
+	for _, opt := range config.SecurityOpt {
+		if strings.Contains(opt, "unconfined") || strings.Replace(opt, ":", "=", 1) == "label=disable" {
+			return "the security option " + opt
+		}
+	}
+	modes := []struct{ name, value string }{
+		{"PID", config.PidMode},
+		{"IPC", config.IpcMode},
+		{"network", config.NetworkMode},
+		{"UTS", config.UTSMode},
+		{"user", config.UsernsMode},
+	}
+	for _, mode := range modes {
+		if mode.value == "host" {
+			return "the host's " + mode.name + " namespace"
+		}
+	}
+	return ""
+}
+
+// Returns the first host path that's bind-mounted, if any.
+func (config *hostConfig) hostBind() string {
+	for _, bind := range config.Binds {
+		source := strings.SplitN(bind, ":", 2)[0]
+		if strings.HasPrefix(source, "/") {
+			return source
+		}
+	}
+	for _, mount := range config.Mounts {
+		if strings.EqualFold(mount.Type, "bind") {
+			return mount.Source
+		}
+		if device := volumeDevice(mount.VolumeOptions.DriverConfig.Options); device != "" {
+			return device
+		}
+	}
+	return ""
+}
+
+// Returns what a local volume with the given driver options mounts from
+// the host, if anything: its device, which is a host path when it's
+// bind-mounted.
+func volumeDevice(opts map[string]string) string {
+	if device := opts["device"]; device != "" {
+		return device
+	}
+	for _, opt := range strings.Split(opts["o"], ",") {
+		if opt == "bind" || opt == "rbind" {
+			return "a bind mount"
+		}
+	}
+	return ""
+}
+
+// Returns the host configs in a container create or start request body.
+// Create requests have one under "HostConfig", and older API versions
+// also read one at the top level; start requests consist of one. Either
+// can take effect, so both are checked.
+func containerHostConfigs(data []byte) ([]*hostConfig, error) {
+	var body struct {
+		hostConfig
+		HostConfig *hostConfig
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("the request body couldn't be checked: %s", err)
+	}
+
+	configs := []*hostConfig{&body.hostConfig}
+	if body.HostConfig != nil {
+		configs = append(configs, body.HostConfig)
+	}
+	return configs, nil
+}
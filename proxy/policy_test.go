@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newRequest(method, path, body string) *http.Request {
+	req, _ := http.NewRequest(method, "http://docker"+path, strings.NewReader(body))
+	return req
+}
+
+func TestPolicyReadOnly(t *testing.T) {
+	policy := &Policy{ReadOnly: true}
+
+	if err := policy.Check(newRequest("GET", "/v1.12/containers/json", "")); err != nil {
+		t.Errorf("expected GET to be allowed, got %v", err)
+	}
+	if err := policy.Check(newRequest("POST", "/v1.12/containers/abc/stop", "")); err == nil {
+		t.Error("expected POST to be denied")
+	}
+}
+
+func TestPolicyDenyRules(t *testing.T) {
+	policy := &Policy{Deny: []PolicyRule{
+		{Method: "DELETE", Path: "/containers"},
+		{Path: "/containers/*/kill"},
+	}}
+
+	denied := []*http.Request{
+		newRequest("DELETE", "/v1.12/containers/abc", ""),
+		newRequest("delete", "/containers/abc", ""),
+		newRequest("POST", "/v1.12/containers/abc/kill", ""),
+	}
+	for _, req := range denied {
+		if err := policy.Check(req); err == nil {
+			t.Errorf("expected %s %s to be denied", req.Method, req.URL.Path)
+		}
+	}
+
+	allowed := []*http.Request{
+		newRequest("DELETE", "/v1.12/images/ubuntu", ""),
+		newRequest("GET", "/v1.12/containers/abc/json", ""),
+		newRequest("POST", "/v1.12/containers/abc/stop", ""),
+	}
+	for _, req := range allowed {
+		if err := policy.Check(req); err != nil {
+			t.Errorf("expected %s %s to be allowed, got %v", req.Method, req.URL.Path, err)
+		}
+	}
+}
+
+func TestPolicyDenyPrivilegedAndHostBinds(t *testing.T) {
+	policy := &Policy{DenyPrivileged: true, DenyHostBinds: true}
+
+	denied := []*http.Request{
+		newRequest("POST", "/v1.12/containers/create", `{"Image": "ubuntu", "HostConfig": {"Privileged": true}}`),
+		newRequest("POST", "/v1.12/containers/abc/start", `{"Privileged": true}`),
+		newRequest("POST", "/v1.12/containers/abc/start", `{"Binds": ["/etc:/host-etc"]}`),
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"Mounts": [{"Type": "bind", "Source": "/var/run/docker.sock"}]}}`),
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"CapAdd": ["ALL"]}}`),
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"CapAdd": ["cap_sys_admin"]}}`),
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"PidMode": "host"}}`),
+		newRequest("POST", "/v1.12/containers/create", `{"NetworkMode": "host", "HostConfig": {"NetworkMode": "bridge"}}`),
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"Devices": [{"PathOnHost": "/dev/sda"}]}}`),
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"SecurityOpt": ["apparmor=unconfined"]}}`),
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"Mounts": [{"Type": "volume", "VolumeOptions": {"DriverConfig": {"Options": {"type": "none", "o": "bind", "device": "/"}}}}]}}`),
+		newRequest("POST", "/v1.24/containers/abc/exec", `{"Cmd": ["sh"], "Privileged": true}`),
+		newRequest("POST", "/v1.24/volumes/create", `{"Name": "root", "DriverOpts": {"type": "none", "o": "bind", "device": "/"}}`),
+	}
+	for _, req := range denied {
+		if err := policy.Check(req); err == nil {
+			t.Errorf("expected %s %s to be denied", req.Method, req.URL.Path)
+		}
+	}
+
+	allowed := []*http.Request{
+		newRequest("POST", "/v1.24/containers/create", `{"HostConfig": {"CapAdd": ["NET_BIND_SERVICE"], "NetworkMode": "bridge"}}`),
+		newRequest("POST", "/v1.24/containers/abc/exec", `{"Cmd": ["sh"]}`),
+		newRequest("POST", "/v1.24/volumes/create", `{"Name": "data", "DriverOpts": {"size": "10G"}}`),
+	}
+	for _, req := range allowed {
+		if err := policy.Check(req); err != nil {
+			t.Errorf("expected %s %s to be allowed, got %v", req.Method, req.URL.Path, err)
+		}
+	}
+
+	req := newRequest("POST", "/v1.12/containers/create", `{"Image": "ubuntu", "HostConfig": {"Binds": ["data:/data"]}}`)
+	if err := policy.Check(req); err != nil {
+		t.Errorf("expected a named volume to be allowed, got %v", err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if !strings.Contains(string(body), `"Image": "ubuntu"`) {
+		t.Errorf("expected the request body to be preserved, got %q", body)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	file, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.Close()
+
+	for _, data := range []string{`
+read_only: false
+deny_privileged: true
+deny:
+  - method: DELETE
+    path: /containers
+`, `{
+  "read_only": false,
+  "deny_privileged": true,
+  "deny": [{"method": "DELETE", "path": "/containers"}]
+}`} {
+		if err := ioutil.WriteFile(file.Name(), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		policy, err := LoadPolicy(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !policy.DenyPrivileged || len(policy.Deny) != 1 || policy.Deny[0].Method != "DELETE" {
+			t.Errorf("unexpected policy: %+v", policy)
+		}
+	}
+
+	for _, data := range []string{
+		`{"deny_privliged": true}`,
+		`{"deny": [{"method": "DELETE", "paths": "/containers"}]}`,
+		`{"deny": [{"path": "containers"}]}`,
+		"deny_privliged: true\n",
+		"deny:\n  - path: /containers\n    methd: DELETE\n",
+	} {
+		if err := ioutil.WriteFile(file.Name(), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPolicy(file.Name()); err == nil {
+			t.Errorf("expected an error loading %q", data)
+		}
+	}
+}
+
+func TestProxyDeniesRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("expected the request not to be forwarded, got %s %s", r.Method, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) { return net.Dial("tcp", ts.Listener.Addr().String()) },
+	)
+	p.Policy = &Policy{ReadOnly: true}
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	req, _ := http.NewRequest("DELETE", "http://"+p.Listener.Addr().String()+"/v1.12/containers/abc", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 403 {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body["message"], "read-only") {
+		t.Errorf("expected a message about the proxy being read-only, got %q", body["message"])
+	}
+}
@@ -1,63 +1,393 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/orchardup/go-orchard/api"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrProxyClosed is returned by Serve after a call to Shutdown.
+var ErrProxyClosed = errors.New("proxy: closed")
+
+// ErrProxyIdle is returned by Serve when it stops because there have been
+// no connections for IdleTimeout.
+var ErrProxyIdle = errors.New("proxy: idle timeout")
+
+// How long a TLS client has to complete its handshake before its
+// connection is closed, so that one that never sends anything doesn't
+// hold the proxy open.
+var HandshakeTimeout = 10 * time.Second
+
+// ShutdownError is returned by Shutdown when its context is done before
+// active connections have finished, and they're closed.
+type ShutdownError struct {
+	// Closed is the number of client connections that were closed.
+	Closed int
+
+	// Err is the context's error.
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("proxy: closed %d active connections: %s", e.Closed, e.Err)
+}
+
 type Proxy struct {
-	ErrorChannel chan error
-	ListenFunc   func() (net.Listener, error)
-	DialFunc     func() (net.Conn, error)
+	ListenFunc func() (net.Listener, error)
+	DialFunc   func() (net.Conn, error)
+
+	Listener net.Listener
+
+	// If Logger, Policy or AuthToken is set, connections are parsed as
+	// Docker Remote API HTTP traffic rather than forwarded as raw bytes,
+	// so that each request can be logged and checked against the policy.
+	// With AuthToken, requests must carry it as a bearer token in their
+	// Authorization header.
+	Logger    *RequestLogger
+	Policy    *Policy
+	AuthToken string
+
+	// If Route is set, connections are parsed as HTTP and each request
+	// is forwarded to the upstream Route picks for it, rather than to
+	// DialFunc.
+	Route func(req *http.Request) (*Upstream, error)
+
+	// DialRetry decides how failed upstream dials are retried.
+	DialRetry *api.RetryPolicy
 
-	Listener *net.Listener
+	// If HealthCheckInterval is set, Serve checks that the upstream
+	// Docker daemon responds to /_ping that often, and OnHealthChange is
+	// called whenever it goes up or down.
+	HealthCheckInterval time.Duration
+	OnHealthChange      func(status HealthStatus)
+
+	// If IdleTimeout is set, Serve stops accepting connections and
+	// returns ErrProxyIdle once there have been none for that long.
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	closing  bool
+	forced   bool
+	conns    map[net.Conn]bool
+	idle     map[net.Conn]bool
+	active   sync.WaitGroup
+	stopOnce sync.Once
+	health   HealthStatus
+	healthMu sync.Mutex
+	metrics  proxyMetrics
+
+	lastActive time.Time
+	idledOut   bool
 }
 
 func New(listenFunc func() (net.Listener, error), dialFunc func() (net.Conn, error)) *Proxy {
 	p := new(Proxy)
 
-	p.ErrorChannel = make(chan error)
 	p.ListenFunc = listenFunc
 	p.DialFunc = dialFunc
+	p.conns = make(map[net.Conn]bool)
+	p.idle = make(map[net.Conn]bool)
+
+	retry := DefaultDialRetry
+	p.DialRetry = &retry
+	p.health.State = HealthUnknown
 
 	return p
 }
 
-func (p *Proxy) Start() {
+// Listen starts listening with ListenFunc, so that errors can be reported
+// before calling Serve.
+func (p *Proxy) Listen() error {
 	listener, err := p.ListenFunc()
-	p.Listener = &listener
 	if err != nil {
-		p.ErrorChannel <- err
-		return
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		listener.Close()
+		return ErrProxyClosed
+	}
+	p.Listener = listener
+	return nil
+}
+
+// Serve accepts connections and forwards each one upstream until the
+// listener fails, Shutdown is called or the context is done. It calls
+// Listen first if that hasn't been done. Temporary accept errors are
+// retried with backoff.
+func (p *Proxy) Serve(ctx context.Context) error {
+	if p.listener() == nil {
+		if err := p.Listen(); err != nil {
+			return err
+		}
 	}
+	listener := p.listener()
 
-	p.ErrorChannel <- nil
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.closeListener()
+		case <-stop:
+		}
+	}()
 
+	if p.HealthCheckInterval > 0 {
+		go p.checkHealth(p.HealthCheckInterval, stop)
+	}
+	if p.IdleTimeout > 0 {
+		go p.exitWhenIdle(p.IdleTimeout, stop)
+	}
+
+	var backoff time.Duration
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
-			panic(err)
+			if p.isClosing() {
+				if p.isIdledOut() {
+					return ErrProxyIdle
+				}
+				return ErrProxyClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				fmt.Fprintf(os.Stderr, "error accepting connection: %s; retrying in %s\n", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
 		}
-		go p.ForwardConnection(clientConn)
+		backoff = 0
+
+		clientConn = &countingConn{clientConn, &p.metrics}
+		if !p.trackConn(clientConn) {
+			clientConn.Close()
+			if p.isIdledOut() {
+				return ErrProxyIdle
+			}
+			return ErrProxyClosed
+		}
+		go func() {
+			defer p.active.Done()
+			defer p.untrackConn(clientConn)
+			p.ForwardConnection(clientConn)
+		}()
 	}
 }
 
-func (p *Proxy) Stop() {
-	if *p.Listener != nil {
-		(*p.Listener).Close()
+// Shutdown stops accepting connections and waits for active ones to
+// finish. In HTTP mode, connections that are idle between requests are
+// closed straight away. If the context is done first, remaining
+// connections are closed and a *ShutdownError is returned, counting them.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.closeListener()
+
+	p.mu.Lock()
+	for conn := range p.idle {
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	drained := make(chan bool)
+	go func() {
+		p.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		// Connections are untracked as they finish closing, so they're
+		// counted first.
+		closed := 0
+		p.mu.Lock()
+		p.forced = true
+		for conn, isClient := range p.conns {
+			if isClient {
+				closed++
+			}
+			conn.Close()
+		}
+		p.mu.Unlock()
+		<-drained
+		return &ShutdownError{Closed: closed, Err: ctx.Err()}
+	}
+}
+
+// ActiveConnections returns the number of connections being forwarded.
+func (p *Proxy) ActiveConnections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	clients := 0
+	for _, isClient := range p.conns {
+		if isClient {
+			clients++
+		}
+	}
+	return clients
+}
+
+func (p *Proxy) listener() net.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Listener
+}
+
+func (p *Proxy) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+func (p *Proxy) closeListener() {
+	p.mu.Lock()
+	p.closing = true
+	listener := p.Listener
+	p.mu.Unlock()
+
+	if listener != nil {
+		p.stopOnce.Do(func() { listener.Close() })
 	}
 }
 
+// Records a client connection, unless the proxy is shutting down.
+func (p *Proxy) trackConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closing {
+		return false
+	}
+	p.conns[conn] = true
+	p.active.Add(1)
+	atomic.AddUint64(&p.metrics.totalConnections, 1)
+	return true
+}
+
+func (p *Proxy) untrackConn(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+	delete(p.idle, conn)
+	p.lastActive = time.Now()
+}
+
+func (p *Proxy) isIdledOut() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.idledOut
+}
+
+// Closes the listener once there have been no client connections for
+// timeout, or stops when stop is closed.
+func (p *Proxy) exitWhenIdle(timeout time.Duration, stop chan bool) {
+	p.mu.Lock()
+	p.lastActive = time.Now()
+	p.mu.Unlock()
+
+	interval := timeout / 10
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		p.mu.Lock()
+		idle := len(p.conns) == 0 && time.Since(p.lastActive) >= timeout
+		if idle {
+			p.idledOut = true
+		}
+		p.mu.Unlock()
+
+		if idle {
+			p.closeListener()
+			return
+		}
+	}
+}
+
+// Marks a client connection as waiting for its next HTTP request, or not.
+// Returns false if the connection should be closed instead because the
+// proxy is shutting down.
+func (p *Proxy) setIdle(conn net.Conn, idle bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if idle {
+		if p.closing {
+			return false
+		}
+		p.idle[conn] = true
+	} else {
+		delete(p.idle, conn)
+	}
+	return true
+}
+
 func (p *Proxy) ForwardConnection(clientConn net.Conn) {
 	defer clientConn.Close()
-	serverConn, err := p.DialFunc()
+
+	// TLS clients are authenticated before anything is dialled for them.
+	if tlsConn, ok := clientConn.(interface {
+		Handshake() error
+	}); ok {
+		clientConn.SetDeadline(time.Now().Add(HandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		clientConn.SetDeadline(time.Time{})
+	}
+
+	if p.Route != nil {
+		p.forwardRouted(clientConn)
+		return
+	}
+
+	if p.Logger != nil || p.Policy != nil || p.AuthToken != "" {
+		p.forwardUpstreamHTTP(clientConn)
+		return
+	}
+
+	serverConn, err := p.dialUpstream(p.DialFunc)
+	p.recordHealth(err)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error connecting upstream: %s\n", err)
+		p.rejectConnection(clientConn, err)
 		return
 	}
 	defer serverConn.Close()
+
+	if !p.trackUpstream(serverConn) {
+		return
+	}
+	defer p.untrackConn(serverConn)
+
 	complete := make(chan bool)
 	go Copy(serverConn, clientConn, complete)
 	go Copy(clientConn, serverConn, complete)
@@ -65,6 +395,53 @@ func (p *Proxy) ForwardConnection(clientConn net.Conn) {
 	<-complete
 }
 
+// Forwards HTTP requests to the proxy's upstream, which isn't dialled
+// until the first request has been authenticated and checked against the
+// policy, so that clients without the token can't make the proxy do
+// anything.
+func (p *Proxy) forwardUpstreamHTTP(clientConn net.Conn) {
+	var server *upstreamConn
+	defer func() {
+		if server != nil {
+			server.Close()
+			p.untrackConn(server.Conn)
+		}
+	}()
+
+	p.forwardHTTP(clientConn, func(req *http.Request) (func() (*upstreamConn, error), error) {
+		return func() (*upstreamConn, error) {
+			if server != nil {
+				return server, nil
+			}
+			conn, err := p.dialUpstream(p.DialFunc)
+			p.recordHealth(err)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error connecting upstream: %s\n", err)
+				return nil, fmt.Errorf("Error connecting to the host's Docker daemon: %s", err)
+			}
+			if !p.trackUpstream(conn) {
+				conn.Close()
+				return nil, ErrProxyClosed
+			}
+			server = &upstreamConn{conn, bufio.NewReader(conn)}
+			return server, nil
+		}, nil
+	})
+}
+
+// Records an upstream connection so that it's closed along with client
+// ones on a forced shutdown, though it isn't counted as an active
+// connection. Returns false if a forced shutdown has already happened.
+func (p *Proxy) trackUpstream(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.forced {
+		return false
+	}
+	p.conns[conn] = false
+	return true
+}
+
 func Copy(to net.Conn, from net.Conn, complete chan bool) {
 	io.Copy(to, from)
 	CloseWrite(to)
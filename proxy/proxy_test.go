@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/orchardup/go-orchard/tlsconfig"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Starts a TCP server that echoes back each line it's sent.
+func echoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintln(conn, scanner.Text())
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func newTestProxy(t *testing.T, upstream net.Listener) *Proxy {
+	p := New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) { return net.Dial("tcp", upstream.Addr().String()) },
+	)
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestServeForwardsConnections(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(context.Background()) }()
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(conn, "hello")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Errorf("expected 'hello', got %q", line)
+	}
+	conn.Close()
+
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected clean shutdown, got %v", err)
+	}
+	if err := <-served; err != ErrProxyClosed {
+		t.Errorf("expected ErrProxyClosed, got %v", err)
+	}
+}
+
+func TestServeStopsWhenContextDone(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(ctx) }()
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != ErrProxyClosed && err != context.Canceled {
+			t.Errorf("expected Serve() to stop cleanly, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve() didn't return after context was canceled")
+	}
+}
+
+func TestShutdownWaitsForActiveConnections(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	go p.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(conn, "hello")
+	bufio.NewReader(conn).ReadString('\n')
+
+	if n := p.ActiveConnections(); n != 1 {
+		t.Errorf("expected 1 active connection, got %d", n)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+
+	start := time.Now()
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected clean shutdown, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("expected Shutdown() to wait for the active connection")
+	}
+}
+
+func TestShutdownClosesConnectionsAfterDeadline(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	go p.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "hello")
+	bufio.NewReader(conn).ReadString('\n')
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = p.Shutdown(ctx)
+	if shutdownErr, ok := err.(*ShutdownError); !ok || shutdownErr.Err != context.DeadlineExceeded || shutdownErr.Closed != 1 {
+		t.Errorf("expected DeadlineExceeded after closing 1 connection, got %v", err)
+	}
+	if n := p.ActiveConnections(); n != 0 {
+		t.Errorf("expected no active connections, got %d", n)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// A listener whose first Accept calls fail with the given errors.
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeRetriesTemporaryErrors(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	p.Listener = &flakyListener{p.Listener, []error{temporaryError{}, temporaryError{}}}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "hello")
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if line != "hello\n" {
+		t.Errorf("expected 'hello', got %q", line)
+	}
+}
+
+func TestServeReturnsListenerErrors(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	broken := errors.New("listener broke")
+	p := newTestProxy(t, upstream)
+	defer p.Listener.Close()
+	p.Listener = &flakyListener{p.Listener, []error{broken}}
+
+	if err := p.Serve(context.Background()); err != broken {
+		t.Errorf("expected %v, got %v", broken, err)
+	}
+}
+
+func TestServeStopsWhenIdle(t *testing.T) {
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	p.IdleTimeout = 100 * time.Millisecond
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(context.Background()) }()
+
+	// An open connection keeps the proxy running past the timeout.
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(conn, "hello")
+	bufio.NewReader(conn).ReadString('\n')
+
+	select {
+	case err := <-served:
+		t.Fatalf("expected Serve() to keep running with an open connection, got %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	conn.Close()
+
+	select {
+	case err := <-served:
+		if err != ErrProxyIdle {
+			t.Errorf("expected ErrProxyIdle, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve() didn't return after being idle")
+	}
+	p.Shutdown(context.Background())
+}
+
+func TestActivationListenersIgnoresOtherProcesses(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+
+	listeners, err := ActivationListeners()
+	if err != nil || listeners != nil {
+		t.Errorf("expected no listeners, got %v, %v", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("expected LISTEN_FDS to be unset")
+	}
+}
+
+func TestTLSHandshakeTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { HandshakeTimeout = timeout }(HandshakeTimeout)
+	HandshakeTimeout = 50 * time.Millisecond
+
+	upstream := echoServer(t)
+	defer upstream.Close()
+
+	certPEM, keyPEM, err := tlsconfig.GenerateCA("Test Proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(
+		func() (net.Listener, error) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			return tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+		},
+		func() (net.Conn, error) { return net.Dial("tcp", upstream.Addr().String()) },
+	)
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+
+	// A client that never starts the handshake is disconnected.
+	conn, err := net.Dial("tcp", p.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("the proxy didn't close the connection")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Upstream is a named Docker daemon that a routing proxy can forward
+// requests to.
+type Upstream struct {
+	Name     string
+	DialFunc func() (net.Conn, error)
+}
+
+// RouteError is returned by a proxy's Route function when a request can't
+// be forwarded, and is sent to the client as a Docker-style error.
+type RouteError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *RouteError) Error() string {
+	return err.Message
+}
+
+// RouteByHost returns a Route function that picks an upstream by name,
+// from a "/hosts/NAME/" prefix on the request path (which is removed
+// before the request is forwarded) or the X-Orchard-Host header. Requests
+// with neither go to defaultName. lookup returns nil for unknown names.
+func RouteByHost(defaultName string, lookup func(name string) *Upstream) func(req *http.Request) (*Upstream, error) {
+	return func(req *http.Request) (*Upstream, error) {
+		name := req.Header.Get("X-Orchard-Host")
+		req.Header.Del("X-Orchard-Host")
+
+		if strings.HasPrefix(req.URL.Path, "/hosts/") {
+			parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/hosts/"), "/", 2)
+			name = parts[0]
+			req.URL.Path = "/"
+			if len(parts) == 2 {
+				req.URL.Path += parts[1]
+			}
+			req.URL.RawPath = ""
+		}
+
+		if name == "" {
+			name = defaultName
+		}
+		upstream := lookup(name)
+		if upstream == nil {
+			return nil, &RouteError{http.StatusNotFound, fmt.Sprintf("No such Orchard host: %s", name)}
+		}
+		return upstream, nil
+	}
+}
+
+// Forwards requests from the client to the upstreams picked by p.Route,
+// keeping a connection open to each one that's used.
+func (p *Proxy) forwardRouted(clientConn net.Conn) {
+	servers := make(map[string]*upstreamConn)
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+			p.untrackConn(server.Conn)
+		}
+	}()
+
+	p.forwardHTTP(clientConn, func(req *http.Request) (func() (*upstreamConn, error), error) {
+		upstream, err := p.Route(req)
+		if err != nil {
+			return nil, err
+		}
+		return func() (*upstreamConn, error) {
+			if server, ok := servers[upstream.Name]; ok {
+				return server, nil
+			}
+
+			conn, err := p.dialUpstream(upstream.DialFunc)
+			if err != nil {
+				return nil, &RouteError{http.StatusBadGateway, fmt.Sprintf("Error connecting to Orchard host %s: %s", upstream.Name, err)}
+			}
+			if !p.trackUpstream(conn) {
+				conn.Close()
+				return nil, ErrProxyClosed
+			}
+			server := &upstreamConn{conn, bufio.NewReader(conn)}
+			servers[upstream.Name] = server
+			return server, nil
+		}, nil
+	})
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteByHost(t *testing.T) {
+	upstreams := map[string]*Upstream{
+		"default": {Name: "default"},
+		"web":     {Name: "web"},
+	}
+	route := RouteByHost("default", func(name string) *Upstream { return upstreams[name] })
+
+	tests := []struct {
+		path, header, host, forwardedPath string
+	}{
+		{"/v1.12/containers/json", "", "default", "/v1.12/containers/json"},
+		{"/hosts/web/v1.12/containers/json", "", "web", "/v1.12/containers/json"},
+		{"/hosts/web", "", "web", "/"},
+		{"/containers/json", "web", "web", "/containers/json"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://docker"+test.path, nil)
+		if test.header != "" {
+			req.Header.Set("X-Orchard-Host", test.header)
+		}
+		upstream, err := route(req)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.path, err)
+			continue
+		}
+		if upstream.Name != test.host {
+			t.Errorf("%s: expected host %q, got %q", test.path, test.host, upstream.Name)
+		}
+		if req.URL.Path != test.forwardedPath {
+			t.Errorf("%s: expected path %q, got %q", test.path, test.forwardedPath, req.URL.Path)
+		}
+		if req.Header.Get("X-Orchard-Host") != "" {
+			t.Errorf("%s: expected X-Orchard-Host header to be removed", test.path)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://docker/hosts/nope/info", nil)
+	_, err := route(req)
+	if routeErr, ok := err.(*RouteError); !ok || routeErr.StatusCode != 404 {
+		t.Errorf("expected a 404 RouteError, got %#v", err)
+	}
+}
+
+func TestProxyRoutesRequests(t *testing.T) {
+	upstreams := map[string]*Upstream{}
+	for _, name := range []string{"default", "web"} {
+		name := name
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		defer ts.Close()
+		upstreams[name] = &Upstream{
+			Name:     name,
+			DialFunc: func() (net.Conn, error) { return net.Dial("tcp", ts.Listener.Addr().String()) },
+		}
+	}
+
+	p := New(func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") }, nil)
+	p.Route = RouteByHost("default", func(name string) *Upstream { return upstreams[name] })
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	baseURL := "http://" + p.Listener.Addr().String()
+
+	for path, expected := range map[string]string{
+		"/info":            "default /info",
+		"/hosts/web/info":  "web /info",
+		"/hosts/web/_ping": "web /_ping",
+	} {
+		resp, err := http.Get(baseURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, body)
+		}
+	}
+
+	resp, err := http.Get(baseURL + "/hosts/nope/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != 404 || body["message"] != "No such Orchard host: nope" {
+		t.Errorf("expected a 404 with a Docker-style message, got %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestRoutingProxyChecksPolicyOnRewrittenPath(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Errorf("expected the request not to be forwarded, got %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+	upstream := &Upstream{
+		Name:     "default",
+		DialFunc: func() (net.Conn, error) { return net.Dial("tcp", ts.Listener.Addr().String()) },
+	}
+
+	p := New(func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") }, nil)
+	p.Route = RouteByHost("default", func(name string) *Upstream {
+		if name == "default" {
+			return upstream
+		}
+		return nil
+	})
+	p.Policy = &Policy{DenyPrivileged: true, Deny: []PolicyRule{{Method: "DELETE", Path: "/containers"}}}
+	if err := p.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(context.Background())
+	defer p.Shutdown(context.Background())
+
+	baseURL := "http://" + p.Listener.Addr().String()
+	for _, req := range []struct{ method, path, body string }{
+		{"POST", "/hosts/default/v1.40/containers/create", `{"Image": "ubuntu", "HostConfig": {"Privileged": true}}`},
+		{"DELETE", "/hosts/default/containers/abc", ""},
+		{"DELETE", "/hosts/default/v1.12/containers/abc", ""},
+	} {
+		httpReq, _ := http.NewRequest(req.method, baseURL+req.path, strings.NewReader(req.body))
+		httpReq.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 403 {
+			t.Errorf("%s %s: expected 403, got %d", req.method, req.path, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(baseURL + "/hosts/default/v1.40/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("expected an allowed request to be forwarded, got %d", resp.StatusCode)
+	}
+}
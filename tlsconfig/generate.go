@@ -0,0 +1,107 @@
+package tlsconfig
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+)
+
+// How long generated certificates are valid for.
+var CertificateLifetime = 3 * 365 * 24 * time.Hour
+
+// Generates a self-signed CA certificate and its key, PEM-encoded.
+func GenerateCA(commonName string) ([]byte, []byte, error) {
+	template, err := newTemplate(commonName)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	return generate(template, nil, nil)
+}
+
+// Generates a certificate and key signed by the given CA, PEM-encoded.
+// Server certificates are valid for the given DNS names and IP addresses;
+// client certificates ignore them.
+func GenerateCertificate(caCertPEMData, caKeyPEMData []byte, commonName string, hosts []string, client bool) ([]byte, []byte, error) {
+	caCert, err := ParseCertificate(caCertPEMData)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKey, err := parseRSAKey(caKeyPEMData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := newTemplate(commonName)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+
+	return generate(template, caCert, caKey)
+}
+
+func newTemplate(commonName string) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Orchard"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(CertificateLifetime),
+	}, nil
+}
+
+// Creates a key and a certificate for it from the template, signed by
+// the parent, or self-signed if the parent is nil.
+func generate(template, parent *x509.Certificate, parentKey *rsa.PrivateKey) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+func parseRSAKey(keyPEMData []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEMData)
+	if block == nil {
+		return nil, errors.New("No private key found in PEM data")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
@@ -1,25 +1,28 @@
 package tlsconfig
 
 import (
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/orchardup/go-orchard/vendor/crypto/tls"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
-func GetTLSConfig(clientCertPEMData, clientKeyPEMData []byte) (*tls.Config, error) {
+// Returns a TLS config for connecting to a host's Docker daemon with its
+// client certificate, verifying the daemon against the CA certificates
+// from GetCACertificates.
+func GetTLSConfig(clientCertPEMData, clientKeyPEMData []byte, caFile string) (*tls.Config, error) {
 	certPool := x509.NewCertPool()
 
-	certChainPath := os.Getenv("ORCHARD_HOST_CA")
-	if certChainPath != "" {
-		certChainData, err := ioutil.ReadFile(certChainPath)
-		if err != nil {
-			return nil, err
-		}
-		certPool.AppendCertsFromPEM(certChainData)
-	} else {
-		certPool.AppendCertsFromPEM([]byte(orchardCerts))
+	certChainData, err := GetCACertificates(caFile)
+	if err != nil {
+		return nil, err
 	}
+	certPool.AppendCertsFromPEM(certChainData)
 
 	clientCert, err := tls.X509KeyPair(clientCertPEMData, clientKeyPEMData)
 	if err != nil {
@@ -34,6 +37,44 @@ func GetTLSConfig(clientCertPEMData, clientKeyPEMData []byte) (*tls.Config, erro
 	return config, nil
 }
 
+// Returns the PEM-encoded CA certificates that hosts' Docker daemons are
+// verified against: those in the file named by ORCHARD_HOST_CA, or else
+// caFile, such as a profile's host_ca, or else Orchard's own CA.
+func GetCACertificates(caFile string) ([]byte, error) {
+	certChainPath := os.Getenv("ORCHARD_HOST_CA")
+	if certChainPath == "" {
+		certChainPath = caFile
+	}
+	if certChainPath != "" {
+		return ioutil.ReadFile(certChainPath)
+	}
+	return []byte(orchardCerts), nil
+}
+
+// Parses the first certificate in a block of PEM data.
+func ParseCertificate(certPEMData []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, certPEMData = pem.Decode(certPEMData)
+		if block == nil {
+			return nil, errors.New("No certificate found in PEM data")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// Returns the SHA-256 fingerprint of a certificate as colon-separated hex.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
 var orchardCerts string = `-----BEGIN CERTIFICATE-----
 MIIDizCCAnOgAwIBAgIJANOkcdAljaXsMA0GCSqGSIb3DQEBBQUAMFwxCzAJBgNV
 BAYTAkdCMQ8wDQYDVQQIDAZMb25kb24xIjAgBgNVBAoMGU9yY2hhcmQgTGFib3Jh
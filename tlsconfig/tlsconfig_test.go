@@ -0,0 +1,57 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCertificate(t *testing.T) {
+	// Blocks that aren't certificates are skipped.
+	_, keyPEM, err := GenerateCA("Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ParseCertificate(append(keyPEM, orchardCerts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.Subject.CommonName != "Orchard Root CA" {
+		t.Errorf("expected the first certificate, got %s", cert.Subject)
+	}
+	if expected := time.Date(2018, time.September, 9, 19, 58, 6, 0, time.UTC); !cert.NotAfter.Equal(expected) {
+		t.Errorf("expected it to expire at %s, got %s", expected, cert.NotAfter)
+	}
+	if fingerprint := Fingerprint(cert); fingerprint != "EA:24:0B:C0:2C:B0:38:E9:93:FB:1C:53:2F:FC:F9:A4:A7:E6:51:A8:4E:0D:AF:1A:31:AC:27:C4:07:FD:21:D4" {
+		t.Errorf("unexpected fingerprint %s", fingerprint)
+	}
+
+	for _, data := range []string{"", "not PEM", string(keyPEM)} {
+		if _, err := ParseCertificate([]byte(data)); err == nil {
+			t.Errorf("expected an error parsing %q", data)
+		}
+	}
+}
+
+func TestFingerprintOfGeneratedCertificate(t *testing.T) {
+	certPEM, _, err := GenerateCA("Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.ToUpper(fmt.Sprintf("%x", sha256.Sum256(cert.Raw)))
+	fingerprint := Fingerprint(cert)
+	if len(fingerprint) != 32*3-1 || strings.Replace(fingerprint, ":", "", -1) != expected {
+		t.Errorf("expected the colon-separated SHA-256 %s, got %s", expected, fingerprint)
+	}
+	if lifetime := cert.NotAfter.Sub(time.Now()); lifetime <= CertificateLifetime-time.Minute || lifetime > CertificateLifetime {
+		t.Errorf("expected it to expire in %s, got %s", CertificateLifetime, lifetime)
+	}
+}
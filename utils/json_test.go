@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalStrictJSON(t *testing.T) {
+	var value struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	if err := UnmarshalStrictJSON([]byte(`{"name": "web", "tags": ["a", "b"]}`), &value); err != nil {
+		t.Fatal(err)
+	}
+	if value.Name != "web" || len(value.Tags) != 2 {
+		t.Errorf("unexpected value: %+v", value)
+	}
+
+	for _, data := range []string{
+		`{"name": "web", "tgas": ["a"]}`,
+		`{"name": "web"} {}`,
+		`{"name": 1}`,
+		`name: web`,
+		``,
+	} {
+		if err := UnmarshalStrictJSON([]byte(data), &value); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+
+	err := UnmarshalStrictJSON([]byte(`{"tgas": []}`), &value)
+	if err == nil || !strings.Contains(err.Error(), `"tgas"`) {
+		t.Errorf("expected the unknown key in the error, got %v", err)
+	}
+}
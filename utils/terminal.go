@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Returns the ID of the foreground process group of the terminal f is, or
+// an error if f isn't a terminal. This works on Linux and OS X alike.
+func ForegroundProcessGroup(f *os.File) (int, error) {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+// Reports whether f is a terminal. Asking for its foreground process
+// group only succeeds for terminals.
+func IsTerminal(f *os.File) bool {
+	_, err := ForegroundProcessGroup(f)
+	return err == nil
+}
@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func Capitalize(str string) string {
@@ -21,6 +23,31 @@ func HumanSize(size int64) string {
 	return fmt.Sprintf("%d%s", size, units[i])
 }
 
+// Human-readable duration, e.g. "About a minute" or "3 hours", in the
+// style of Docker's output.
+func HumanDuration(d time.Duration) string {
+	if seconds := int(d.Seconds()); seconds < 1 {
+		return "Less than a second"
+	} else if seconds < 60 {
+		return fmt.Sprintf("%d seconds", seconds)
+	} else if minutes := int(d.Minutes()); minutes == 1 {
+		return "About a minute"
+	} else if minutes < 60 {
+		return fmt.Sprintf("%d minutes", minutes)
+	} else if hours := int(d.Hours()); hours == 1 {
+		return "About an hour"
+	} else if hours < 48 {
+		return fmt.Sprintf("%d hours", hours)
+	} else if hours < 24*7*2 {
+		return fmt.Sprintf("%d days", hours/24)
+	} else if hours < 24*30*3 {
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	} else if hours < 24*365*2 {
+		return fmt.Sprintf("%d months", hours/24/30)
+	}
+	return fmt.Sprintf("%d years", int(d.Hours())/24/365)
+}
+
 // Parses a human-readable string representing an amount of RAM
 // in bytes, kibibytes, mebibytes or gibibytes, and returns the
 // number of bytes, or -1 if the string is unparseable.
@@ -54,3 +81,21 @@ func RAMInBytes(size string) (bytes int64, err error) {
 
 	return memLimit, nil
 }
+
+// Reads a line of input from stdin, giving up if the context is
+// canceled first.
+func ReadLine(ctx context.Context) (string, error) {
+	lines := make(chan string, 1)
+	go func() {
+		var line string
+		fmt.Scanln(&line)
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		return line, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
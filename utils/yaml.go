@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/orchardup/go-orchard/vendor/gopkg.in/yaml.v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Decodes YAML, or JSON, which is YAML too, into v like
+// UnmarshalStrictJSON: `json` struct tags apply, and keys that don't
+// match a field are an error, as are duplicate keys.
+func UnmarshalStrictYAML(data []byte, v interface{}) error {
+	var value interface{}
+	if err := yaml.UnmarshalStrict(data, &value); err != nil {
+		return err
+	}
+	value, err := jsonValue(value)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return UnmarshalStrictJSON(data, v)
+}
+
+// Converts a value decoded from YAML into one that can be encoded as
+// JSON, whose object keys must be strings.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v isn't a string", key)
+			}
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = item
+		}
+		return object, nil
+	case []interface{}:
+		for i, item := range value {
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = item
+		}
+	}
+	return value, nil
+}
+
+// Encodes a value as YAML. The value is first encoded as JSON, so
+// `json` struct tags apply, and object keys come out sorted.
+func MarshalYAML(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, line := range yamlLines(value) {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), nil
+}
+
+func yamlLines(value interface{}) []string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return []string{"{}"}
+		}
+
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var lines []string
+		for _, key := range keys {
+			child := yamlLines(v[key])
+			if isYAMLCollection(v[key]) {
+				lines = append(lines, yamlString(key)+":")
+				for _, line := range child {
+					lines = append(lines, "  "+line)
+				}
+			} else {
+				lines = append(lines, yamlString(key)+": "+child[0])
+			}
+		}
+		return lines
+
+	case []interface{}:
+		if len(v) == 0 {
+			return []string{"[]"}
+		}
+
+		var lines []string
+		for _, item := range v {
+			for i, line := range yamlLines(item) {
+				if i == 0 {
+					lines = append(lines, "- "+line)
+				} else {
+					lines = append(lines, "  "+line)
+				}
+			}
+		}
+		return lines
+
+	case string:
+		return []string{yamlString(v)}
+	case json.Number:
+		return []string{v.String()}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	}
+
+	return []string{"null"}
+}
+
+func isYAMLCollection(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+// Quotes a string if YAML would otherwise read it as something else.
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "", "null", "~", "true", "false", "yes", "no", "on", "off":
+		return strconv.Quote(s)
+	}
+
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+
+	if strings.TrimSpace(s) != s || strings.ContainsAny(s, ":#{}[],&*?|<>=!%@`\"'\\\n\t") || strings.HasPrefix(s, "-") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestMarshalYAML(t *testing.T) {
+	type host struct {
+		Name  string   `json:"name"`
+		Size  int      `json:"size"`
+		IP    string   `json:"ip_address"`
+		Tags  []string `json:"tags"`
+		Extra map[string]interface{}
+	}
+
+	hosts := []host{
+		{Name: "default", Size: 512, IP: "1.2.3.4", Tags: []string{"web", "true"}},
+		{Name: "db", Size: 1024, Extra: map[string]interface{}{"note": "a: b"}},
+	}
+
+	data, err := MarshalYAML(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `- Extra: null
+  ip_address: 1.2.3.4
+  name: default
+  size: 512
+  tags:
+    - web
+    - "true"
+- Extra:
+    note: "a: b"
+  ip_address: ""
+  name: db
+  size: 1024
+  tags: null
+`
+	if string(data) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, data)
+	}
+}
+
+func TestUnmarshalStrictYAML(t *testing.T) {
+	type rule struct {
+		Method string `json:"method"`
+		Path   string `json:"path"`
+	}
+	var value struct {
+		ReadOnly bool   `json:"read_only"`
+		Deny     []rule `json:"deny"`
+	}
+	yamlData := `
+read_only: true
+deny:
+  - method: DELETE
+    path: /containers
+  - path: /containers/*/exec
+`
+	jsonData := "{\n\t\"read_only\": true,\n\t\"deny\": [{\"method\": \"DELETE\", \"path\": \"/containers\"}, {\"path\": \"/containers/*/exec\"}]\n}"
+	for _, data := range []string{yamlData, jsonData} {
+		value.Deny = nil
+		if err := UnmarshalStrictYAML([]byte(data), &value); err != nil {
+			t.Fatal(err)
+		}
+		if !value.ReadOnly || len(value.Deny) != 2 || value.Deny[0].Method != "DELETE" || value.Deny[1].Path != "/containers/*/exec" {
+			t.Errorf("unexpected value: %+v", value)
+		}
+	}
+
+	for _, data := range []string{
+		"read_onyl: true\n",
+		"deny:\n  - paths: /containers\n",
+		"read_only: true\nread_only: false\n",
+		"read_only: [\n",
+		"1: true\n",
+		"read_only: yes please\n",
+	} {
+		if err := UnmarshalStrictYAML([]byte(data), &value); err == nil {
+			t.Errorf("expected an error decoding %q", data)
+		}
+	}
+}